@@ -0,0 +1,171 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/modb-dev/modb/query"
+	"github.com/modb-dev/modb/store"
+	"github.com/tidwall/redcon"
+	"github.com/valyala/fastjson"
+)
+
+// aggregate accumulates the values found at a path across many documents.
+type aggregate struct {
+	count int // documents with the field present
+	nums  int // of which were numbers
+	sum   float64
+	min   float64
+	max   float64
+}
+
+func (agg *aggregate) add(val *fastjson.Value) {
+	agg.count++
+	if val.Type() != fastjson.TypeNumber {
+		return
+	}
+	n := val.GetFloat64()
+	if agg.nums == 0 || n < agg.min {
+		agg.min = n
+	}
+	if agg.nums == 0 || n > agg.max {
+		agg.max = n
+	}
+	agg.nums++
+	agg.sum += n
+}
+
+// result returns the aggregate for fn, or false if there were no numbers to
+// take the min, max or average of.
+func (agg *aggregate) result(fn string) (float64, bool) {
+	switch fn {
+	case "count":
+		return float64(agg.count), true
+	case "sum":
+		return agg.sum, true
+	}
+	if agg.nums == 0 {
+		return 0, false
+	}
+	switch fn {
+	case "min":
+		return agg.min, true
+	case "max":
+		return agg.max, true
+	case "avg":
+		return agg.sum / float64(agg.nums), true
+	}
+	return 0, false
+}
+
+// groupName gives the name of the group a value falls in, which is the string
+// itself for strings or the JSON for anything else.
+func groupName(val *fastjson.Value) string {
+	if val.Type() == fastjson.TypeString {
+		return string(val.GetStringBytes())
+	}
+	return val.String()
+}
+
+func formatNumber(n float64) string {
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
+
+func Aggregate(db store.Storage, conn redcon.Conn, args ...[]byte) {
+	// Usage:
+	// > aggregate pageviews: sum count
+	// > aggregate pageviews: avg count GROUP BY site
+	//
+	// Aggregates the field at the path across every document under the prefix.
+	// `count` counts the documents which have the field, whilst sum, min, max
+	// and avg only take numbers into account. Replies with the number, or nil
+	// if there was nothing to take the min, max or average of. With GROUP BY,
+	// replies with [group, number] pairs ordered by group, leaving out any
+	// document without the group field.
+
+	if len(args) != 3 && len(args) != 6 {
+		conn.WriteError("ERR wrong number of arguments: aggregate <prefix> count|sum|min|max|avg <json-path> [GROUP BY <path>]")
+		return
+	}
+
+	prefix := string(args[0])
+	fn := strings.ToLower(string(args[1]))
+	path := string(args[2])
+	switch fn {
+	case "count", "sum", "min", "max", "avg":
+	default:
+		conn.WriteError("ERR unknown aggregate '" + fn + "'")
+		return
+	}
+
+	groupBy := ""
+	if len(args) == 6 {
+		if strings.ToLower(string(args[3])) != "group" || strings.ToLower(string(args[4])) != "by" {
+			conn.WriteError("ERR syntax error near '" + string(args[3]) + "'")
+			return
+		}
+		groupBy = string(args[5])
+	}
+
+	groups := map[string]*aggregate{}
+	err := store.GetRange(db, prefix, prefix+"\xff", false, "", func(key string, doc *store.Doc) bool {
+		if doc.Deleted() {
+			return true
+		}
+
+		name := ""
+		if groupBy != "" {
+			group := query.Field(doc.Value(), groupBy)
+			if group == nil {
+				return true
+			}
+			name = groupName(group)
+		}
+		if groups[name] == nil {
+			groups[name] = &aggregate{}
+		}
+
+		if val := query.Field(doc.Value(), path); val != nil {
+			groups[name].add(val)
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("store.GetRange() - err: %s", err)
+		conn.WriteError("ERR reading from datastore")
+		return
+	}
+
+	if groupBy == "" {
+		agg := groups[""]
+		if agg == nil {
+			agg = &aggregate{}
+		}
+		n, ok := agg.result(fn)
+		if !ok {
+			conn.WriteNull()
+			return
+		}
+		conn.WriteBulkString(formatNumber(n))
+		return
+	}
+
+	var names []string
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	conn.WriteArray(len(names))
+	for _, name := range names {
+		conn.WriteArray(2)
+		conn.WriteBulkString(name)
+		if n, ok := groups[name].result(fn); ok {
+			conn.WriteBulkString(formatNumber(n))
+		} else {
+			conn.WriteNull()
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAggregateScan(t *testing.T) {
+	client := testServer(t)
+	putUsers(t, client)
+
+	tests := []struct {
+		args []string
+		want interface{}
+	}{
+		{[]string{"count", "n"}, "151"},
+		{[]string{"sum", "n"}, "12175"},
+		{[]string{"max", "n"}, "1000"},
+		{[]string{"count", "n", "GROUP", "BY", "team"}, []interface{}{
+			[]interface{}{"0", "51"},
+			[]interface{}{"1", "50"},
+			[]interface{}{"2", "50"},
+		}},
+	}
+	for _, test := range tests {
+		got := do(t, client, append([]string{"aggregate", "user:"}, test.args...)...)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("aggregate %v = %v, want %v", test.args, got, test.want)
+		}
+	}
+}
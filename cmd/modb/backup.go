@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/modb-dev/modb/store"
+	"github.com/tidwall/redcon"
+	"github.com/valyala/fastjson"
+)
+
+func Backup(dir string, db store.Storage, conn redcon.Conn, args ...[]byte) {
+	// Usage:
+	// > backup modb-full.backup
+	// > backup modb-incr.jsonl <since-op-id>
+	//
+	// Writes a consistent backup of the datastore to a file of that name in the
+	// server's --backup-dir, whilst writes carry on. A full backup is in the
+	// datastore's own format (bbolt's Tx.WriteTo, badger's Backup, or a leveldb
+	// snapshot) and holds everything, including schemas, indexes and views, so
+	// it can only be restored into the same type of datastore. With since, only
+	// the ops after that id are written, in the same format as `modb dump`,
+	// which makes an incremental backup to restore on top of a full one. Replies
+	// with the number of ops in the backup and the id to use as since next time.
+	//
+	// An incremental backup holds nothing but ops, so data entries, schemas,
+	// indexes and views changed since the full backup aren't in it. It also goes
+	// by op id rather than by when an op was written, so an op loaded from
+	// elsewhere after a backup, with an id from before it, is left out of every
+	// later incremental backup. Take a full backup after either.
+
+	if len(args) != 1 && len(args) != 2 {
+		conn.WriteError("ERR wrong number of arguments: backup <name> [since-op-id]")
+		return
+	}
+
+	if dir == "" {
+		conn.WriteError("ERR backups are off, start the server with --backup-dir")
+		return
+	}
+	name := string(args[0])
+	if name == "" || name == "." || name == ".." || name != filepath.Base(name) {
+		conn.WriteError("ERR invalid backup name '" + name + "'")
+		return
+	}
+	path := filepath.Join(dir, name)
+	since := ""
+	if len(args) == 2 {
+		since = string(args[1])
+		if _, err := store.IdTime(since); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+	}
+
+	// write to one side so that a failed backup never leaves half a file
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		log.Printf("os.Create() - err: %s", err)
+		conn.WriteError("ERR " + err.Error())
+		return
+	}
+
+	var n int
+	var last string
+	if since == "" {
+		n, last, err = backupFull(db, f)
+	} else {
+		n, last, err = backupSince(db, f, since)
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		log.Printf("backup() - err: %s", err)
+		os.Remove(tmp)
+		conn.WriteError("ERR backup failed: " + err.Error())
+		return
+	}
+
+	conn.WriteArray(2)
+	conn.WriteInt(n)
+	if last == "" {
+		conn.WriteNull()
+	} else {
+		conn.WriteBulkString(last)
+	}
+}
+
+// backupFull writes a full backup of the datastore to w, returning how many
+// ops were in the log just beforehand and the largest op id amongst them. Every
+// op up to that id is in the backup, along with any written in the meantime,
+// which an incremental backup since that id includes again for load to skip.
+func backupFull(db store.Storage, w io.Writer) (int, string, error) {
+	n := 0
+	last := ""
+	err := db.IterateLog("", func(k, v string) bool {
+		_, id := store.SplitLogKey(k)
+		n++
+		if id > last {
+			last = id
+		}
+		return true
+	})
+	if err != nil {
+		return n, last, err
+	}
+
+	bw := bufio.NewWriter(w)
+	err = db.Backup(bw)
+	if err != nil {
+		return n, last, err
+	}
+	return n, last, bw.Flush()
+}
+
+// backupSince writes the ops after since to w in the dump format, returning how
+// many were written and the largest op id amongst them, or since if none were.
+func backupSince(db store.Storage, w io.Writer, since string) (int, string, error) {
+	bw := bufio.NewWriter(w)
+	n := 0
+	last := since
+	var writeErr error
+	err := db.IterateLog("", func(k, v string) bool {
+		change, err := store.ParseLogEntry(k, v)
+		if err != nil {
+			log.Printf("Skipping %s", err)
+			return true
+		}
+		if fastjson.Validate(change.Diff) != nil {
+			log.Printf("Skipping log entry '%s' with an invalid diff", k)
+			return true
+		}
+		if change.Id <= since {
+			return true
+		}
+		if change.Id > last {
+			last = change.Id
+		}
+
+		n++
+		_, writeErr = fmt.Fprintln(bw, change.JSON())
+		return writeErr == nil
+	})
+	if err != nil {
+		return n, last, err
+	}
+	if writeErr != nil {
+		return n, last, writeErr
+	}
+	return n, last, bw.Flush()
+}
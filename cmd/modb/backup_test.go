@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/modb-dev/modb/store"
+)
+
+func TestBackupName(t *testing.T) {
+	client := testServer(t)
+	do(t, client, "put", "user:1", `{"n":1}`)
+
+	for _, name := range []string{"", ".", "..", "../out.jsonl", "/tmp/out.jsonl", "dir/out.jsonl"} {
+		reply, err := client.Do("backup", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := reply.(ReplyError); !ok {
+			t.Errorf("backup %q = %v, want an error", name, reply)
+		}
+	}
+	do(t, client, "backup", "full.backup")
+}
+
+// defs returns the schemas and index entries of a datastore, to compare.
+func defs(t *testing.T, db store.Storage) []string {
+	var got []string
+	err := db.IterateSchemas(func(prefix, schema string) {
+		got = append(got, "schema "+prefix+" "+schema)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.IterateIndex("byteam", "", "", func(value, key string) bool {
+		got = append(got, "byteam "+value+" "+key)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestBackupRestore(t *testing.T) {
+	for _, datastore := range []string{"bbolt", "level", "badger"} {
+		t.Run(datastore, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "modb-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := NewStore(datastore, filepath.Join(dir, "db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			indexer, err := NewIndexer(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer indexer.Close()
+
+			put := func(from, to int) {
+				for i := from; i < to; i++ {
+					err := db.Put("user:"+strconv.Itoa(i), `{"team":"`+strconv.Itoa(i%2)+`"}`)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if err := db.PutSchema("user:", `{"type":"object"}`); err != nil {
+				t.Fatal(err)
+			}
+			put(0, 10)
+			if err := indexer.Create("byteam", "user:", "team"); err != nil {
+				t.Fatal(err)
+			}
+
+			backupTo := func(name, since string) string {
+				f, err := os.Create(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				var last string
+				if since == "" {
+					_, last, err = backupFull(db, f)
+				} else {
+					_, last, err = backupSince(db, f, since)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				return last
+			}
+			last := backupTo("full", "")
+			put(5, 15)
+			if err := db.Inc("user:1", `{"n":true}`); err != nil {
+				t.Fatal(err)
+			}
+			indexer.Wait()
+			backupTo("incr", last)
+
+			path := filepath.Join(dir, "restored")
+			err = restore(datastore, path, []string{filepath.Join(dir, "full"), filepath.Join(dir, "incr")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			restored, err := NewStore(datastore, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer restored.Close()
+
+			checked, mismatched, err := compareSignatures(db, restored, func(key, a, b string) {
+				t.Errorf("%s: %s != %s", key, a, b)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if checked != 15 || mismatched != 0 {
+				t.Errorf("checked %d keys with %d mismatched, want 15 and 0", checked, mismatched)
+			}
+			if got, want := defs(t, restored), defs(t, db); !reflect.DeepEqual(got, want) {
+				t.Errorf("restored definitions %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestRestoreWrongType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	full := filepath.Join(dir, "full")
+	if err := ioutil.WriteFile(full, []byte(`{"key":"a","data":{}}`+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, datastore := range []string{"bbolt", "level", "badger"} {
+		path := filepath.Join(dir, datastore)
+		if err := restore(datastore, path, []string{full}); err == nil {
+			t.Errorf("%s restored a dump as a full backup", datastore)
+		}
+		if _, err := os.Stat(path); err == nil {
+			t.Errorf("%s left a datastore behind", datastore)
+		}
+	}
+}
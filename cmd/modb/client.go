@@ -1,21 +1,24 @@
 package main
 
 import (
-	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"log"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/chilts/sid"
 	"github.com/modb-dev/modb/store"
+	"github.com/tidwall/match"
 	"github.com/tidwall/redcon"
 	"github.com/tidwall/sjson"
 	"github.com/valyala/fastjson"
 )
 
-func NewClientServer(addr string, db store.Storage) *redcon.Server {
+func NewClientServer(addr string, db *Guard, indexer *Indexer, views *Views, backupDir string) *redcon.Server {
 	return redcon.NewServer(addr,
 		func(conn redcon.Conn, cmd redcon.Command) {
 			switch strings.ToLower(string(cmd.Args[0])) {
@@ -35,9 +38,13 @@ func NewClientServer(addr string, db store.Storage) *redcon.Server {
 				conn.WriteString(sid.IdBase64())
 
 			case "put":
-				// put <key> <json>
+				// put <key> <json> [EX <seconds>]
 				Put(db, conn, cmd.Args[1:]...)
 
+			case "expire":
+				// expire <key> <seconds>
+				Expire(db, conn, cmd.Args[1:]...)
+
 			case "inc":
 				// inc <key> <field>
 				// inc chilts logins
@@ -51,11 +58,106 @@ func NewClientServer(addr string, db store.Storage) *redcon.Server {
 				// del <key> [json]
 				Del(db, conn, cmd.Args[1:]...)
 
+			case "max":
+				// max <key> <field> <number>
+				Max(db, conn, cmd.Args[1:]...)
+
+			case "min":
+				// min <key> <field> <number>
+				Min(db, conn, cmd.Args[1:]...)
+
+			case "mvset":
+				// mvset <key> <field> <json> [<seen-id>...]
+				MvSet(db, conn, cmd.Args[1:]...)
+
+			case "resolve":
+				// resolve <key> <field> <json>
+				Resolve(db, conn, cmd.Args[1:]...)
+
+			case "textins":
+				// textins <key> <field> <pos-id> <string>
+				TextIns(db, conn, cmd.Args[1:]...)
+
+			case "textdel":
+				// textdel <key> <field> <char-id...>
+				TextDel(db, conn, cmd.Args[1:]...)
+
+			case "textids":
+				// textids <key> <field>
+				TextIds(db, conn, cmd.Args[1:]...)
+
+			case "get":
+				// get <key> [AT <timestamp|op-id>]
+				Get(db, conn, cmd.Args[1:]...)
+
+			case "schema":
+				// schema set <prefix> <json>
+				// schema get <prefix>
+				// schema del <prefix>
+				// schema list
+				Schema(db, conn, cmd.Args[1:]...)
+
+			case "mget":
+				// mget <key> [<key>...]
+				MGet(db, conn, cmd.Args[1:]...)
+
+			case "exists":
+				// exists <key> [<key>...]
+				Exists(db, conn, cmd.Args[1:]...)
+
+			case "scan":
+				// scan <cursor> [MATCH <pattern>] [COUNT <n>] [AT <timestamp|op-id>]
+				Scan(db, conn, cmd.Args[1:]...)
+
+			case "range":
+				// range <start> <end> [limit] [reverse] [AT <timestamp|op-id>]
+				Range(db, conn, cmd.Args[1:]...)
+
+			case "history":
+				// history <key> [since-id] [limit]
+				History(db, conn, cmd.Args[1:]...)
+
+			case "subscribe":
+				// subscribe <key...> [SINCE <op-id>]
+				Subscribe(db, conn, false, cmd.Args[1:]...)
+
+			case "psubscribe":
+				// psubscribe <pattern...> [SINCE <op-id>]
+				Subscribe(db, conn, true, cmd.Args[1:]...)
+
+			case "index":
+				// index create <name> <key-prefix> <json-path>
+				// index query <name> <value> | <min> <max>
+				// index drop <name>
+				// index list
+				IndexCmd(indexer, db, conn, cmd.Args[1:]...)
+
+			case "view":
+				// view create <name> <key-prefix> <[group-path=]value-path> sum|count|max
+				// view get <name> [<group>]
+				// view top <name> [<n>]
+				// view drop <name>
+				// view list
+				ViewCmd(views, conn, cmd.Args[1:]...)
+
+			case "query":
+				// query <prefix> [WHERE <expr>] [FIELDS <path,...>] [LIMIT <n>]
+				Query(indexer, db, conn, cmd.Args[1:]...)
+
+			case "aggregate":
+				// aggregate <prefix> count|sum|min|max|avg <json-path> [GROUP BY <path>]
+				Aggregate(db, conn, cmd.Args[1:]...)
+
 			case "signature":
 				// signature <key>
 				Signature(db, conn, cmd.Args[1:]...)
 
+			case "backup":
+				// backup <name> [since-op-id]
+				Backup(backupDir, db, conn, cmd.Args[1:]...)
+
 			case "dump":
+				// dump [log|data] [prefix] [CURSOR <cursor>] [COUNT <n>]
 				Dump(db, conn, cmd.Args[1:]...)
 
 			case "quit":
@@ -78,15 +180,18 @@ func NewClientServer(addr string, db store.Storage) *redcon.Server {
 	)
 }
 
-func Put(db store.Storage, conn redcon.Conn, args ...[]byte) {
-	if len(args) != 2 {
-		conn.WriteError("ERR wrong number of arguments: put <key> <json>")
+func Put(db *Guard, conn redcon.Conn, args ...[]byte) {
+	// Usage:
+	// > put session:abc {"user":"chilts"} [EX <seconds>]
+
+	if len(args) != 2 && len(args) != 4 {
+		conn.WriteError("ERR wrong number of arguments: put <key> <json> [EX <seconds>]")
 		return
 	}
 
 	err := fastjson.ValidateBytes(args[1])
 	if err != nil {
-		log.Printf("db.Put() - err: ", err)
+		log.Printf("db.Put() - err: %s", err)
 		conn.WriteError("ERR " + err.Error())
 		return
 	}
@@ -95,17 +200,87 @@ func Put(db store.Storage, conn redcon.Conn, args ...[]byte) {
 	key := string(args[0])
 	val := string(args[1])
 
-	// ToDo: validate both name and json.
-	err = db.Put(key, val)
+	expire := ""
+	if len(args) == 4 {
+		if strings.ToLower(string(args[2])) != "ex" {
+			conn.WriteError("ERR syntax error near '" + string(args[2]) + "'")
+			return
+		}
+		expire, err = deadline(string(args[3]))
+		if err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+	}
+
+	// the JSON is checked against any schema registered for the key, and any
+	// expiry is written along with it
+	if expire != "" {
+		err = db.PutExpire(key, val, expire)
+	} else {
+		err = db.Put(key, val)
+	}
 	if err != nil {
-		log.Printf("db.Put() - err: ", err)
-		conn.WriteError("ERR writing to datastore")
+		log.Printf("db.Put() - err: %s", err)
+		writeError(conn, err)
 		return
 	}
 
 	conn.WriteString("OK")
 }
 
+func Expire(db store.Storage, conn redcon.Conn, args ...[]byte) {
+	// Usage:
+	// > expire session:abc 3600
+	//
+	// The deadline is written as an absolute time so that every node agrees on
+	// it. Once it passes the key reads as if deleted, and a later put, del or
+	// expire replaces it. Replies with 1, or 0 if the key doesn't exist.
+
+	if len(args) != 2 {
+		conn.WriteError("ERR wrong number of arguments: expire <key> <seconds>")
+		return
+	}
+
+	key := string(args[0])
+	json, err := deadline(string(args[1]))
+	if err != nil {
+		conn.WriteError("ERR " + err.Error())
+		return
+	}
+
+	doc, err := store.Get(db, key)
+	if err != nil {
+		log.Printf("store.Get() - err: %s", err)
+		conn.WriteError("ERR reading from datastore")
+		return
+	}
+	if doc == nil || doc.Deleted() {
+		conn.WriteInt(0)
+		return
+	}
+
+	err = db.Expire(key, json)
+	if err != nil {
+		log.Printf("db.Expire() - err: %s", err)
+		writeError(conn, err)
+		return
+	}
+
+	conn.WriteInt(1)
+}
+
+// deadline turns a number of seconds from now into the body of an expire op.
+// The seconds must be a finite number above zero.
+func deadline(arg string) (string, error) {
+	seconds, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) || seconds <= 0 {
+		return "", fmt.Errorf("invalid expire time '%s'", arg)
+	}
+	at := time.Now().UTC().Add(time.Duration(seconds * float64(time.Second)))
+	return sjson.Set("{}", "deadline", at.Format(time.RFC3339Nano))
+}
+
 func Inc(db store.Storage, conn redcon.Conn, args ...[]byte) {
 	// Usage:
 	// > inc chilts logins
@@ -123,7 +298,7 @@ func Inc(db store.Storage, conn redcon.Conn, args ...[]byte) {
 	for i := 1; i < len(args); i++ {
 		json, err = sjson.Set(json, string(args[i]), true)
 		if err != nil {
-			log.Printf("error creating json, err:", err)
+			log.Printf("error creating json, err: %s", err)
 			conn.WriteError("ERR error creating JSON")
 			return
 		}
@@ -131,8 +306,8 @@ func Inc(db store.Storage, conn redcon.Conn, args ...[]byte) {
 
 	err = db.Inc(key, json)
 	if err != nil {
-		log.Printf("db.Inc() - err: ", err)
-		conn.WriteError("ERR writing to datastore")
+		log.Printf("db.Inc() - err: %s", err)
+		writeError(conn, err)
 		return
 	}
 
@@ -165,7 +340,7 @@ func IncBy(db store.Storage, conn redcon.Conn, args ...[]byte) {
 		}
 		json, err = sjson.Set(json, field, count)
 		if err != nil {
-			log.Printf("error creating json, err:", err)
+			log.Printf("error creating json, err: %s", err)
 			conn.WriteError("ERR error creating JSON")
 			return
 		}
@@ -173,8 +348,8 @@ func IncBy(db store.Storage, conn redcon.Conn, args ...[]byte) {
 
 	err := db.IncBy(key, json)
 	if err != nil {
-		log.Printf("db.Add() - err: ", err)
-		conn.WriteError("ERR writing to datastore")
+		log.Printf("db.IncBy() - err: %s", err)
+		writeError(conn, err)
 		return
 	}
 
@@ -205,60 +380,1021 @@ func Del(db store.Storage, conn redcon.Conn, args ...[]byte) {
 
 	err := fastjson.Validate(json)
 	if err != nil {
-		log.Printf("db.Del() - err: ", err)
+		log.Printf("db.Del() - err: %s", err)
 		conn.WriteError("ERR " + err.Error())
 		return
 	}
 
 	err = db.Del(key, json)
 	if err != nil {
-		log.Printf("db.Del() - err: ", err)
-		conn.WriteError("ERR writing to datastore")
+		log.Printf("db.Del() - err: %s", err)
+		writeError(conn, err)
 		return
 	}
 
 	conn.WriteString("OK")
 }
 
-func Dump(db store.Storage, conn redcon.Conn, args ...[]byte) {
+func Max(db store.Storage, conn redcon.Conn, args ...[]byte) {
+	// Usage:
+	// > max chilts lastSeen 1571476800
+
+	register(conn, "max", db.Max, args...)
+}
+
+func Min(db store.Storage, conn redcon.Conn, args ...[]byte) {
+	// Usage:
+	// > min chilts firstSeen 1571476800
+
+	register(conn, "min", db.Min, args...)
+}
+
+// register writes a max or min op, which both take a single field and number.
+func register(conn redcon.Conn, name string, fn func(key, json string) error, args ...[]byte) {
+	if len(args) != 3 {
+		conn.WriteError("ERR wrong number of arguments: " + name + " <key> <field> <number>")
+		return
+	}
+
+	key := string(args[0])
+	field := string(args[1])
+	number, err := strconv.ParseFloat(string(args[2]), 64)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+		conn.WriteError(fmt.Sprintf("ERR invalid number '%s'", string(args[2])))
+		return
+	}
+
+	json, err := sjson.Set("{}", field, number)
+	if err != nil {
+		log.Printf("error creating json, err: %s", err)
+		conn.WriteError("ERR error creating JSON")
+		return
+	}
+
+	err = fn(key, json)
+	if err != nil {
+		log.Printf("db.%s() - err: %s", name, err)
+		writeError(conn, err)
+		return
+	}
+
+	conn.WriteString("OK")
+}
+
+func MvSet(db store.Storage, conn redcon.Conn, args ...[]byte) {
+	// Usage:
+	// > mvset chilts email "andy@example.com" [seen-id...]
+	//
+	// The seen ids are the siblings the client read with `get`. Any siblings
+	// not listed are concurrent with this write and are kept alongside it.
+
+	if len(args) < 3 {
+		conn.WriteError("ERR wrong number of arguments: mvset <key> <field> <json> [<seen-id>...]")
+		return
+	}
+
+	var seen []string
+	for _, id := range args[3:] {
+		seen = append(seen, string(id))
+	}
+
+	mvregister(conn, "MvSet", db.MvSet, args[0], args[1], args[2], seen)
+}
+
+func Resolve(db store.Storage, conn redcon.Conn, args ...[]byte) {
+	// Usage:
+	// > resolve chilts email "andy@example.com"
+
+	if len(args) != 3 {
+		conn.WriteError("ERR wrong number of arguments: resolve <key> <field> <json>")
+		return
+	}
+
+	// supersede every sibling this node currently knows about
+	doc, err := store.Get(db, string(args[0]))
+	if err != nil {
+		log.Printf("store.Get() - err: %s", err)
+		conn.WriteError("ERR reading from datastore")
+		return
+	}
+	var seen []string
+	if doc != nil {
+		seen = doc.Siblings(string(args[1]))
+	}
+
+	mvregister(conn, "Resolve", db.Resolve, args[0], args[1], args[2], seen)
+}
+
+// mvregister writes an op to the multi-value register at field, recording the
+// siblings the write has seen so concurrent writes can be told apart.
+func mvregister(conn redcon.Conn, name string, fn func(key, json string) error, key, field, val []byte, seen []string) {
+	err := fastjson.ValidateBytes(val)
+	if err != nil {
+		conn.WriteError("ERR " + err.Error())
+		return
+	}
+
+	json, err := sjson.Set("{}", "field", string(field))
+	if err == nil {
+		json, err = sjson.SetRaw(json, "value", string(val))
+	}
+	if err == nil {
+		json, err = sjson.Set(json, "seen", append([]string{}, seen...))
+	}
+	if err != nil {
+		log.Printf("error creating json, err: %s", err)
+		conn.WriteError("ERR error creating JSON")
+		return
+	}
+
+	err = fn(string(key), json)
+	if err != nil {
+		log.Printf("db.%s() - err: %s", name, err)
+		writeError(conn, err)
+		return
+	}
+
+	conn.WriteString("OK")
+}
+
+func TextIns(db store.Storage, conn redcon.Conn, args ...[]byte) {
+	// Usage:
+	// > textins doc title ^ "Hello"
+	//
+	// Replies with the id of the insert, where the characters inserted have ids
+	// of `<id>.0`, `<id>.1`, and so on. Use `^` to insert at the start, or else
+	// the id of a character already in the field, even one since deleted.
+
+	if len(args) != 4 {
+		conn.WriteError("ERR wrong number of arguments: textins <key> <field> <pos-id> <string>")
+		return
+	}
+
+	// the characters would never be seen if anchored to one which isn't there
+	key := string(args[0])
+	field := string(args[1])
+	after := string(args[2])
+	if after != store.TextHead {
+		doc, err := store.Get(db, key)
+		if err != nil {
+			log.Printf("store.Get() - err: %s", err)
+			conn.WriteError("ERR reading from datastore")
+			return
+		}
+		if doc == nil || doc.Deleted() || !doc.HasTextId(field, after) {
+			conn.WriteError("ERR unknown position '" + after + "'")
+			return
+		}
+	}
+
+	id := sid.IdBase64()
+	json, err := sjson.Set("{}", "field", field)
+	if err == nil {
+		json, err = sjson.Set(json, "after", after)
+	}
+	if err == nil {
+		json, err = sjson.Set(json, "id", id)
+	}
+	if err == nil {
+		json, err = sjson.Set(json, "text", string(args[3]))
+	}
+	if err != nil {
+		log.Printf("error creating json, err: %s", err)
+		conn.WriteError("ERR error creating JSON")
+		return
+	}
+
+	err = db.TextIns(key, json)
+	if err != nil {
+		log.Printf("db.TextIns() - err: %s", err)
+		writeError(conn, err)
+		return
+	}
+
+	conn.WriteBulkString(id)
+}
+
+func TextDel(db store.Storage, conn redcon.Conn, args ...[]byte) {
+	// Usage:
+	// > textdel doc title <char-id> [<char-id>...]
+
+	if len(args) < 3 {
+		conn.WriteError("ERR wrong number of arguments: textdel <key> <field> <char-id...>")
+		return
+	}
+
+	var ids []string
+	for _, id := range args[2:] {
+		ids = append(ids, string(id))
+	}
+
+	json, err := sjson.Set("{}", "field", string(args[1]))
+	if err == nil {
+		json, err = sjson.Set(json, "ids", ids)
+	}
+	if err != nil {
+		log.Printf("error creating json, err: %s", err)
+		conn.WriteError("ERR error creating JSON")
+		return
+	}
+
+	err = db.TextDel(string(args[0]), json)
+	if err != nil {
+		log.Printf("db.TextDel() - err: %s", err)
+		writeError(conn, err)
+		return
+	}
+
+	conn.WriteString("OK")
+}
+
+func TextIds(db store.Storage, conn redcon.Conn, args ...[]byte) {
+	// Usage:
+	// > textids doc title
+
+	if len(args) != 2 {
+		conn.WriteError("ERR wrong number of arguments: textids <key> <field>")
+		return
+	}
+
+	doc, err := store.Get(db, string(args[0]))
+	if err != nil {
+		log.Printf("store.Get() - err: %s", err)
+		conn.WriteError("ERR reading from datastore")
+		return
+	}
+
+	var ids []string
+	if doc != nil {
+		ids = doc.TextIds(string(args[1]))
+	}
+
+	conn.WriteArray(len(ids))
+	for _, id := range ids {
+		conn.WriteBulkString(id)
+	}
+}
+
+func Get(db store.Storage, conn redcon.Conn, args ...[]byte) {
+	// Usage:
+	// > get chilts [AT 2026-10-18T15:00:00Z]
+	//
+	// With AT, only the ops up to that time (or up to and including that op id)
+	// are replayed, giving the document as it was then.
+
+	if len(args) != 1 && len(args) != 3 {
+		conn.WriteError("ERR wrong number of arguments: get <key> [AT <timestamp|op-id>]")
+		return
+	}
+
+	at := ""
+	if len(args) == 3 {
+		if strings.ToLower(string(args[1])) != "at" {
+			conn.WriteError("ERR syntax error near '" + string(args[1]) + "'")
+			return
+		}
+		var err error
+		at, err = store.ParseAt(string(args[2]))
+		if err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+	}
+
+	doc, err := store.GetAt(db, string(args[0]), at)
+	if err != nil {
+		log.Printf("store.Get() - err: %s", err)
+		conn.WriteError("ERR reading from datastore")
+		return
+	}
+	if doc == nil || doc.Deleted() {
+		conn.WriteNull()
+		return
+	}
+
+	conn.WriteBulkString(doc.String())
+}
+
+func MGet(db store.Storage, conn redcon.Conn, args ...[]byte) {
+	// Usage:
+	// > mget chilts andy
+
+	if len(args) < 1 {
+		conn.WriteError("ERR wrong number of arguments: mget <key> [<key>...]")
+		return
+	}
+
+	docs := make([]*store.Doc, len(args))
+	for i, key := range args {
+		doc, err := store.Get(db, string(key))
+		if err != nil {
+			log.Printf("store.Get() - err: %s", err)
+			conn.WriteError("ERR reading from datastore")
+			return
+		}
+		docs[i] = doc
+	}
+
+	conn.WriteArray(len(docs))
+	for _, doc := range docs {
+		if doc == nil || doc.Deleted() {
+			conn.WriteNull()
+			continue
+		}
+		conn.WriteBulkString(doc.String())
+	}
+}
+
+func Exists(db store.Storage, conn redcon.Conn, args ...[]byte) {
+	// Usage:
+	// > exists chilts [key...]
+	//
+	// Replies with how many of the keys exist, i.e. have not been deleted.
+
+	if len(args) < 1 {
+		conn.WriteError("ERR wrong number of arguments: exists <key> [<key>...]")
+		return
+	}
+
+	count := 0
+	for _, key := range args {
+		doc, err := store.Get(db, string(key))
+		if err != nil {
+			log.Printf("store.Get() - err: %s", err)
+			conn.WriteError("ERR reading from datastore")
+			return
+		}
+		if doc != nil && !doc.Deleted() {
+			count++
+		}
+	}
+
+	conn.WriteInt(count)
+}
+
+func Scan(db store.Storage, conn redcon.Conn, args ...[]byte) {
+	// Usage:
+	// > scan 0 MATCH users:* COUNT 100 [AT <timestamp|op-id>]
+	//
+	// Replies with the next cursor and a page of keys, in the same way as Redis.
+	// A cursor of "0" starts a new scan, and is returned once it has finished.
+	// Deleted keys are still listed since they remain in the log, unless AT is
+	// given, in which case only keys which existed at that point are listed.
+
+	if len(args) < 1 || len(args)%2 != 1 {
+		conn.WriteError("ERR wrong number of arguments: scan <cursor> [MATCH <pattern>] [COUNT <n>] [AT <timestamp|op-id>]")
+		return
+	}
+
+	after := ""
+	if string(args[0]) != "0" {
+		b, err := base64.RawURLEncoding.DecodeString(string(args[0]))
+		if err != nil {
+			conn.WriteError("ERR invalid cursor")
+			return
+		}
+		after = string(b)
+	}
+
+	pattern := "*"
+	count := 10
+	at := ""
+	for i := 1; i < len(args); i += 2 {
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			pattern = string(args[i+1])
+		case "count":
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || n < 1 {
+				conn.WriteError("ERR invalid count '" + string(args[i+1]) + "'")
+				return
+			}
+			count = n
+		case "at":
+			var err error
+			at, err = store.ParseAt(string(args[i+1]))
+			if err != nil {
+				conn.WriteError("ERR " + err.Error())
+				return
+			}
+		default:
+			conn.WriteError("ERR syntax error near '" + string(args[i]) + "'")
+			return
+		}
+	}
+
+	// look at `count` keys, and keep going one more to find out if we're done
+	var keys []string
+	seen := 0
+	cursor := "0"
+	err := db.IterateKeys(after, func(key string) bool {
+		if seen == count {
+			cursor = base64.RawURLEncoding.EncodeToString([]byte(after))
+			return false
+		}
+		seen++
+		after = key
+		if match.Match(key, pattern) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("db.IterateKeys() - err: %s", err)
+		conn.WriteError("ERR reading from datastore")
+		return
+	}
+
+	// only now that iterating has finished can each document be read
+	if at != "" {
+		var existed []string
+		for _, key := range keys {
+			doc, err := store.GetAt(db, key, at)
+			if err != nil {
+				log.Printf("store.GetAt() - err: %s", err)
+				conn.WriteError("ERR reading from datastore")
+				return
+			}
+			if doc != nil && !doc.Deleted() {
+				existed = append(existed, key)
+			}
+		}
+		keys = existed
+	}
+
+	conn.WriteArray(2)
+	conn.WriteBulkString(cursor)
+	conn.WriteArray(len(keys))
+	for _, key := range keys {
+		conn.WriteBulkString(key)
+	}
+}
+
+func Range(db store.Storage, conn redcon.Conn, args ...[]byte) {
 	// Usage:
-	// > dump [log|data]
+	// > range metrics:2026-10-18 metrics:2026-10-19 [limit] [reverse] [AT <timestamp|op-id>]
+	//
+	// Replies with [key, json] pairs for keys from start (inclusive) to end
+	// (exclusive). Use "-" and "+" for no start and no end. Deleted keys are
+	// skipped. With AT, documents are read as they were at that point.
+
+	if len(args) < 2 {
+		conn.WriteError("ERR wrong number of arguments: range <start> <end> [limit] [reverse] [AT <timestamp|op-id>]")
+		return
+	}
+
+	start := string(args[0])
+	if start == "-" {
+		start = ""
+	}
+	end := string(args[1])
+	if end == "+" {
+		end = ""
+	}
+
+	limit := 0
+	reverse := false
+	at := ""
+	for i := 2; i < len(args); i++ {
+		arg := args[i]
+		if strings.ToLower(string(arg)) == "reverse" {
+			reverse = true
+			continue
+		}
+		if strings.ToLower(string(arg)) == "at" && i+1 < len(args) {
+			i++
+			var err error
+			at, err = store.ParseAt(string(args[i]))
+			if err != nil {
+				conn.WriteError("ERR " + err.Error())
+				return
+			}
+			continue
+		}
+		n, err := strconv.Atoi(string(arg))
+		if err != nil || n < 1 {
+			conn.WriteError("ERR invalid limit '" + string(arg) + "'")
+			return
+		}
+		limit = n
+	}
+
+	var keys []string
+	var docs []*store.Doc
+	err := store.GetRange(db, start, end, reverse, at, func(key string, doc *store.Doc) bool {
+		if doc.Deleted() {
+			return true
+		}
+		keys = append(keys, key)
+		docs = append(docs, doc)
+		return limit == 0 || len(docs) < limit
+	})
+	if err != nil {
+		log.Printf("store.GetRange() - err: %s", err)
+		conn.WriteError("ERR reading from datastore")
+		return
+	}
+
+	conn.WriteArray(len(docs))
+	for i, doc := range docs {
+		conn.WriteArray(2)
+		conn.WriteBulkString(keys[i])
+		conn.WriteBulkString(doc.String())
+	}
+}
+
+func IndexCmd(indexer *Indexer, db store.Storage, conn redcon.Conn, args ...[]byte) {
+	// Usage:
+	// > index create users-by-email users: email
+	// > index query users-by-email andy@example.com
+	// > index query users-by-age 18 +
+	//
+	// Values are given as JSON, or as a plain string if they aren't valid JSON.
+	// A query with a min and max is inclusive of both, and "-" and "+" give no
+	// lower or upper bound. Queries reply with the matching keys in index order.
 
 	if len(args) < 1 {
-		// ToDo: Dump All
-		fmt.Println("Log:")
-		db.IterateLog(func(key, val string) {
-			fmt.Printf("* %s=%s\n", key, val)
+		conn.WriteError("ERR wrong number of arguments: index create|query|drop|list [<name>] ...")
+		return
+	}
+
+	action := strings.ToLower(string(args[0]))
+	args = args[1:]
+
+	switch action {
+	case "create":
+		if len(args) != 3 {
+			conn.WriteError("ERR wrong number of arguments: index create <name> <key-prefix> <json-path>")
+			return
+		}
+		err := indexer.Create(string(args[0]), string(args[1]), string(args[2]))
+		if err != nil {
+			log.Printf("indexer.Create() - err: %s", err)
+			writeError(conn, err)
+			return
+		}
+		conn.WriteString("OK")
+
+	case "drop":
+		if len(args) != 1 {
+			conn.WriteError("ERR wrong number of arguments: index drop <name>")
+			return
+		}
+		err := indexer.Drop(string(args[0]))
+		if err != nil {
+			log.Printf("indexer.Drop() - err: %s", err)
+			writeError(conn, err)
+			return
+		}
+		conn.WriteString("OK")
+
+	case "list":
+		indexes := indexer.List()
+		conn.WriteArray(len(indexes))
+		for _, index := range indexes {
+			conn.WriteArray(3)
+			conn.WriteBulkString(index.Name)
+			conn.WriteBulkString(index.Prefix)
+			conn.WriteBulkString(index.Path)
+		}
+
+	case "query":
+		if len(args) != 2 && len(args) != 3 {
+			conn.WriteError("ERR wrong number of arguments: index query <name> <value> | <min> <max>")
+			return
+		}
+		name := string(args[0])
+		if _, ok := indexer.Get(name); !ok {
+			conn.WriteError("ERR unknown index '" + name + "'")
+			return
+		}
+
+		// entries are "<value>\x00<key>", so "\x01" takes in every key with the
+		// last value wanted
+		start := parseIndexValue(string(args[1]))
+		end := start + "\x01"
+		if len(args) == 3 {
+			if string(args[1]) == "-" {
+				start = ""
+			}
+			end = parseIndexValue(string(args[2])) + "\x01"
+			if string(args[2]) == "+" {
+				end = ""
+			}
+		}
+
+		indexer.Wait()
+		var keys []string
+		err := db.IterateIndex(name, start, end, func(value, key string) bool {
+			keys = append(keys, key)
+			return true
 		})
-		fmt.Println("Data:")
-		db.IterateData(func(key, val string) {
-			fmt.Printf("* %s=%s\n", key, val)
+		if err != nil {
+			log.Printf("db.IterateIndex() - err: %s", err)
+			conn.WriteError("ERR reading from datastore")
+			return
+		}
+
+		// an expired document stays in the index until it is purged
+		var live []string
+		for _, key := range keys {
+			doc, err := store.Get(db, key)
+			if err != nil {
+				log.Printf("store.Get() - err: %s", err)
+				conn.WriteError("ERR reading from datastore")
+				return
+			}
+			if doc != nil && !doc.Expired() {
+				live = append(live, key)
+			}
+		}
+		conn.WriteArray(len(live))
+		for _, key := range live {
+			conn.WriteBulkString(key)
+		}
+
+	default:
+		conn.WriteError("ERR unknown index action '" + action + "'")
+	}
+}
+
+func ViewCmd(views *Views, conn redcon.Conn, args ...[]byte) {
+	// Usage:
+	// > view create daily-views pageviews: day=count sum
+	// > view get daily-views 2026-10-19
+	// > view top daily-views 10
+	//
+	// Without a group path the view has a single total, which `view get`
+	// replies with. Otherwise `view get` replies with [group, value] pairs
+	// ordered by group, or the value of just the group asked for, and `view
+	// top` replies with the pairs for the n largest values (10 by default).
+
+	if len(args) < 1 {
+		conn.WriteError("ERR wrong number of arguments: view create|get|top|drop|list [<name>] ...")
+		return
+	}
+
+	action := strings.ToLower(string(args[0]))
+	args = args[1:]
+
+	switch action {
+	case "create":
+		if len(args) != 4 {
+			conn.WriteError("ERR wrong number of arguments: view create <name> <key-prefix> <[group-path=]value-path> sum|count|max")
+			return
+		}
+		err := views.Create(string(args[0]), string(args[1]), string(args[2]), string(args[3]))
+		if err != nil {
+			log.Printf("views.Create() - err: %s", err)
+			writeError(conn, err)
+			return
+		}
+		conn.WriteString("OK")
+
+	case "get":
+		if len(args) != 1 && len(args) != 2 {
+			conn.WriteError("ERR wrong number of arguments: view get <name> [<group>]")
+			return
+		}
+		view, results, err := views.Results(string(args[0]))
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+
+		// a view without groups, or a single group, replies with just a value
+		if len(args) == 2 || view.Group == "" {
+			group := ""
+			if len(args) == 2 {
+				group = string(args[1])
+			}
+			for _, result := range results {
+				if result.Group == group {
+					writeResult(conn, result)
+					return
+				}
+			}
+			// nothing yet, which is a zero sum or count but has no max
+			writeResult(conn, ViewResult{Group: group, Ok: view.Reduce != "max"})
+			return
+		}
+
+		writeResults(conn, results)
+
+	case "top":
+		if len(args) != 1 && len(args) != 2 {
+			conn.WriteError("ERR wrong number of arguments: view top <name> [<n>]")
+			return
+		}
+		n := 10
+		if len(args) == 2 {
+			var err error
+			n, err = strconv.Atoi(string(args[1]))
+			if err != nil || n < 1 {
+				conn.WriteError("ERR invalid count '" + string(args[1]) + "'")
+				return
+			}
+		}
+		_, results, err := views.Results(string(args[0]))
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+
+		sort.SliceStable(results, func(i, j int) bool {
+			if results[i].Ok != results[j].Ok {
+				return results[i].Ok
+			}
+			return results[i].Value > results[j].Value
 		})
-		fmt.Println("End")
-		conn.WriteString("DONE")
+		if len(results) > n {
+			results = results[:n]
+		}
+		writeResults(conn, results)
+
+	case "drop":
+		if len(args) != 1 {
+			conn.WriteError("ERR wrong number of arguments: view drop <name>")
+			return
+		}
+		err := views.Drop(string(args[0]))
+		if err != nil {
+			log.Printf("views.Drop() - err: %s", err)
+			writeError(conn, err)
+			return
+		}
+		conn.WriteString("OK")
+
+	case "list":
+		list := views.List()
+		conn.WriteArray(len(list))
+		for _, view := range list {
+			conn.WriteArray(4)
+			conn.WriteBulkString(view.Name)
+			conn.WriteBulkString(view.Prefix)
+			conn.WriteBulkString(view.MapExpr())
+			conn.WriteBulkString(view.Reduce)
+		}
+
+	default:
+		conn.WriteError("ERR unknown view action '" + action + "'")
+	}
+}
+
+func writeResult(conn redcon.Conn, result ViewResult) {
+	if !result.Ok {
+		conn.WriteNull()
+		return
+	}
+	conn.WriteBulkString(formatNumber(result.Value))
+}
+
+func writeResults(conn redcon.Conn, results []ViewResult) {
+	conn.WriteArray(len(results))
+	for _, result := range results {
+		conn.WriteArray(2)
+		conn.WriteBulkString(result.Group)
+		writeResult(conn, result)
+	}
+}
+
+func Schema(db store.Storage, conn redcon.Conn, args ...[]byte) {
+	// Usage:
+	// > schema set users: {"type":"object","required":["email"]}
+
+	if len(args) < 1 {
+		conn.WriteError("ERR wrong number of arguments: schema set|get|del|list [<prefix>] [<json>]")
 		return
 	}
 
-	thing := string(args[0])
+	action := strings.ToLower(string(args[0]))
+	args = args[1:]
 
-	if thing == "log" {
-		fmt.Println("Log:")
-		db.IterateLog(func(key, val string) {
-			fmt.Printf("* %s=%s\n", key, val)
+	if action == "list" {
+		var prefixes []string
+		err := db.IterateSchemas(func(prefix, schema string) {
+			prefixes = append(prefixes, prefix)
 		})
-		fmt.Println("End")
-	} else if thing == "data" {
-		fmt.Println("Data:")
-		db.IterateData(func(key, val string) {
-			fmt.Printf("* %s=%s\n", key, val)
+		if err != nil {
+			log.Printf("db.IterateSchemas() - err: %s", err)
+			conn.WriteError("ERR reading from datastore")
+			return
+		}
+		conn.WriteArray(len(prefixes))
+		for _, prefix := range prefixes {
+			conn.WriteBulkString(prefix)
+		}
+		return
+	}
+
+	if action == "get" {
+		if len(args) != 1 {
+			conn.WriteError("ERR wrong number of arguments: schema get <prefix>")
+			return
+		}
+		found := ""
+		err := db.IterateSchemas(func(prefix, schema string) {
+			if prefix == string(args[0]) {
+				found = schema
+			}
 		})
-		fmt.Println("End")
-	} else {
-		conn.WriteError("ERR unknown target")
+		if err != nil {
+			log.Printf("db.IterateSchemas() - err: %s", err)
+			conn.WriteError("ERR reading from datastore")
+			return
+		}
+		if found == "" {
+			conn.WriteNull()
+			return
+		}
+		conn.WriteBulkString(found)
+		return
+	}
+
+	if action == "set" {
+		if len(args) != 2 {
+			conn.WriteError("ERR wrong number of arguments: schema set <prefix> <json>")
+			return
+		}
+		err := db.PutSchema(string(args[0]), string(args[1]))
+		if err != nil {
+			log.Printf("db.PutSchema() - err: %s", err)
+			writeError(conn, err)
+			return
+		}
+		conn.WriteString("OK")
+		return
+	}
+
+	if action == "del" {
+		if len(args) != 1 {
+			conn.WriteError("ERR wrong number of arguments: schema del <prefix>")
+			return
+		}
+		err := db.DelSchema(string(args[0]))
+		if err != nil {
+			log.Printf("db.DelSchema() - err: %s", err)
+			writeError(conn, err)
+			return
+		}
+		conn.WriteString("OK")
+		return
+	}
+
+	conn.WriteError("ERR unknown schema action '" + action + "'")
+}
+
+// dumpCount is how many entries dump replies with per page by default.
+const dumpCount = 1000
+
+func Dump(db store.Storage, conn redcon.Conn, args ...[]byte) {
+	// Usage:
+	// > dump [log|data] [prefix] [CURSOR <cursor>] [COUNT <n>]
+	//
+	// Replies with the next cursor and a page of [section, key, value] entries,
+	// where section is "log" or "data", and the key and value are as stored
+	// (so a log entry is "<key>:<id>" and "<op>:<diff>"). Pass the cursor back
+	// to carry on, until it comes back as "0". Without a section both are
+	// dumped, the log first.
+
+	sections := []string{"log", "data"}
+	prefix := ""
+	cursor := ""
+	count := dumpCount
+	for i := 0; i < len(args); i++ {
+		arg := string(args[i])
+		switch {
+		case i == 0 && (arg == "log" || arg == "data"):
+			sections = []string{arg}
+		case strings.ToLower(arg) == "cursor" && i+1 < len(args):
+			i++
+			cursor = string(args[i])
+		case strings.ToLower(arg) == "count" && i+1 < len(args):
+			i++
+			n, err := strconv.Atoi(string(args[i]))
+			if err != nil || n < 1 {
+				conn.WriteError("ERR invalid count '" + string(args[i]) + "'")
+				return
+			}
+			count = n
+		case prefix == "":
+			prefix = arg
+		default:
+			conn.WriteError("ERR syntax error near '" + arg + "'")
+			return
+		}
+	}
+
+	// the cursor is the section and raw key of the last entry sent
+	after := ""
+	if cursor != "" && cursor != "0" {
+		b, err := base64.RawURLEncoding.DecodeString(cursor)
+		parts := strings.SplitN(string(b), ":", 2)
+		if err != nil || len(parts) != 2 {
+			conn.WriteError("ERR invalid cursor")
+			return
+		}
+		for len(sections) > 0 && sections[0] != parts[0] {
+			sections = sections[1:]
+		}
+		after = parts[1]
+	}
+
+	type entry struct {
+		section, key, val string
+	}
+	var entries []entry
+	next := "0"
+	for i, section := range sections {
+		iterate := db.IterateLog
+		if section == "data" {
+			iterate = db.IterateData
+		}
+
+		start := prefix
+		if i == 0 && after != "" {
+			start = after + "\x00"
+		}
+		err := iterate(start, func(key, val string) bool {
+			if !strings.HasPrefix(key, prefix) {
+				return false
+			}
+			entries = append(entries, entry{section, key, val})
+			return len(entries) < count
+		})
+		if err != nil {
+			log.Printf("db.Iterate() - err: %s", err)
+			conn.WriteError("ERR reading from datastore")
+			return
+		}
+
+		if len(entries) == count {
+			last := entries[len(entries)-1]
+			next = base64.RawURLEncoding.EncodeToString([]byte(last.section + ":" + last.key))
+			break
+		}
+	}
+
+	conn.WriteArray(2)
+	conn.WriteBulkString(next)
+	conn.WriteArray(len(entries))
+	for _, e := range entries {
+		conn.WriteArray(3)
+		conn.WriteBulkString(e.section)
+		conn.WriteBulkString(e.key)
+		conn.WriteBulkString(e.val)
+	}
+}
+
+func History(db store.Storage, conn redcon.Conn, args ...[]byte) {
+	// Usage:
+	// > history chilts [since-id] [limit]
+	//
+	// Replies with an [id, op, diff] array for each change after since-id.
+
+	if len(args) < 1 || len(args) > 3 {
+		conn.WriteError("ERR wrong number of arguments: history <key> [since-id] [limit]")
 		return
 	}
 
-	conn.WriteString("DONE")
+	key := string(args[0])
+	since := ""
+	if len(args) > 1 {
+		since = string(args[1])
+	}
+	limit := 0
+	if len(args) > 2 {
+		n, err := strconv.Atoi(string(args[2]))
+		if err != nil || n < 1 {
+			conn.WriteError("ERR invalid limit '" + string(args[2]) + "'")
+			return
+		}
+		limit = n
+	}
+
+	var changes []store.Change
+	err := db.IterateChanges(key, func(change store.Change) {
+		if change.Id <= since {
+			return
+		}
+		if limit > 0 && len(changes) == limit {
+			return
+		}
+		changes = append(changes, change)
+	})
+	if err != nil {
+		log.Printf("db.IterateChanges() - err: %s", err)
+		conn.WriteError("ERR reading from datastore")
+		return
+	}
+
+	conn.WriteArray(len(changes))
+	for _, change := range changes {
+		conn.WriteArray(3)
+		conn.WriteBulkString(change.Id)
+		conn.WriteBulkString(change.Op)
+		conn.WriteBulkString(change.Diff)
+	}
 }
 
 func Signature(db store.Storage, conn redcon.Conn, args ...[]byte) {
@@ -269,17 +1405,24 @@ func Signature(db store.Storage, conn redcon.Conn, args ...[]byte) {
 
 	key := string(args[0])
 
-	count := 0
-	h := sha256.New()
-	db.IterateChanges(key, func(change store.Change) {
-		count++
-		line := change.Id + ":" + change.Key + ":" + change.Op + ":" + change.Diff + "\n"
-		h.Write([]byte(line))
-	})
-
-	sum := fmt.Sprintf("%x", h.Sum(nil))
+	count, sum, err := store.Signature(db, key)
+	if err != nil {
+		log.Printf("store.Signature() - err: %s", err)
+		conn.WriteError("ERR reading from datastore")
+		return
+	}
 
 	conn.WriteArray(2)
 	conn.WriteBulkString(fmt.Sprintf("%d", count))
 	conn.WriteBulkString(sum)
 }
+
+// writeError replies with the reason an op was rejected, or with a generic
+// error for anything that went wrong inside the datastore itself.
+func writeError(conn redcon.Conn, err error) {
+	if rejected, ok := err.(*RejectedError); ok {
+		conn.WriteError("ERR " + rejected.Error())
+		return
+	}
+	conn.WriteError("ERR writing to datastore")
+}
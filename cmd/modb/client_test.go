@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMaxMinNumbers(t *testing.T) {
+	client := testServer(t)
+	do(t, client, "max", "k", "n", "5")
+
+	for _, op := range []string{"max", "min"} {
+		for _, arg := range []string{"NaN", "Inf", "-Inf", "+Inf", "x", ""} {
+			reply, err := client.Do(op, "k", "n", arg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err, ok := reply.(ReplyError); !ok || !strings.HasPrefix(string(err), "ERR invalid number") {
+				t.Errorf("%s %q = %v, want an invalid number error", op, arg, reply)
+			}
+		}
+	}
+	do(t, client, "min", "k", "n", "-1e3")
+
+	if got := do(t, client, "get", "k"); got != `{"n":-1000}` {
+		t.Errorf("get = %v, want {\"n\":-1000}", got)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// benchOps are the ops bench can send, in the order they are reported.
+var benchOps = []string{"put", "inc", "incby", "del", "get"}
+
+func CmdHelpBench(msg string) error {
+	if msg != "" {
+		fmt.Printf("Error: %s\n\n", msg)
+	}
+	fmt.Println("Drive a running server with a mix of ops from many clients at once, then")
+	fmt.Println("report the throughput and the latency percentiles of each op. With pipelining,")
+	fmt.Println("each client sends that many ops before reading their replies, and each op's")
+	fmt.Println("latency is from sending the first to receiving its own reply.")
+	fmt.Println("")
+	fmt.Println("Keys are <prefix><n>, with n chosen from the keyspace either uniformly or")
+	fmt.Println("following a zipfian distribution, where a few keys are much hotter than the")
+	fmt.Println("rest. Each put writes {\"n\": <number>, \"data\": <string of --size bytes>}.")
+	fmt.Println("")
+	fmt.Println("Usage:")
+	fmt.Println("")
+	fmt.Println("  modb bench [flags]")
+	fmt.Println("")
+	fmt.Println("Flags:")
+	fmt.Println("")
+	fmt.Println("  -h, --help")
+	fmt.Println("        help for bench")
+	fmt.Println("")
+	fmt.Println("  --host")
+	fmt.Println("        host of the server (default: localhost)")
+	fmt.Println("")
+	fmt.Println("  --port")
+	fmt.Println("        port of the server (default: 29876)")
+	fmt.Println("")
+	fmt.Println("  --mix")
+	fmt.Println("        weights of each op (default: put=20,inc=20,incby=10,del=5,get=45)")
+	fmt.Println("")
+	fmt.Println("  --requests")
+	fmt.Println("        total number of ops to send (default: 100000)")
+	fmt.Println("")
+	fmt.Println("  --clients")
+	fmt.Println("        number of connections sending ops at once (default: 10)")
+	fmt.Println("")
+	fmt.Println("  --pipeline")
+	fmt.Println("        number of ops each client sends before reading replies (default: 1)")
+	fmt.Println("")
+	fmt.Println("  --keys")
+	fmt.Println("        size of the keyspace (default: 10000)")
+	fmt.Println("")
+	fmt.Println("  --dist")
+	fmt.Println("        distribution of keys: uniform, zipfian (default: uniform)")
+	fmt.Println("")
+	fmt.Println("  --size")
+	fmt.Println("        size in bytes of the data in each put (default: 100)")
+	fmt.Println("")
+	fmt.Println("  --prefix")
+	fmt.Println("        prefix of every key (default: bench:)")
+	fmt.Println("")
+	fmt.Println("Use 'modb help [command]' for more information about a command.")
+	return nil
+}
+
+func CmdBench(opts Opts) error {
+	if opts.Help == true {
+		return CmdHelpBench("")
+	}
+
+	weights, err := parseMix(opts.Mix)
+	if err != nil {
+		return CmdHelpBench(err.Error())
+	}
+	if opts.Requests < 1 || opts.Clients < 1 || opts.Pipeline < 1 || opts.Keys < 1 {
+		return CmdHelpBench("--requests, --clients, --pipeline and --keys must be at least 1")
+	}
+	if opts.Size < 0 {
+		return CmdHelpBench("--size can't be negative")
+	}
+	if opts.Dist != "uniform" && opts.Dist != "zipfian" {
+		return CmdHelpBench("Unknown distribution '" + opts.Dist + "'")
+	}
+	prefix := opts.Prefix
+	if prefix == "" {
+		prefix = "bench:"
+	}
+
+	addr := opts.Host + ":" + strconv.Itoa(opts.Port)
+	clients := make([]*Client, opts.Clients)
+	for i := range clients {
+		clients[i], err = Dial(addr)
+		if err != nil {
+			return err
+		}
+		defer clients[i].Close()
+	}
+
+	fmt.Printf("Benchmarking %s with %d clients, pipeline %d, %d %s keys, %d byte values\n", addr, opts.Clients, opts.Pipeline, opts.Keys, opts.Dist, opts.Size)
+	fmt.Printf("Mix: %s\n\n", opts.Mix)
+
+	data := strings.Repeat("x", opts.Size)
+	var sent int64
+	var wg sync.WaitGroup
+	results := make([]*benchResult, opts.Clients)
+	errs := make([]error, opts.Clients)
+	start := time.Now()
+	for i, client := range clients {
+		wg.Add(1)
+		go func(i int, client *Client) {
+			defer wg.Done()
+			w := &benchWorker{
+				client:  client,
+				rnd:     rand.New(rand.NewSource(time.Now().UnixNano() + int64(i))),
+				weights: weights,
+				prefix:  prefix,
+				data:    data,
+				result:  newBenchResult(),
+			}
+			if opts.Dist == "zipfian" {
+				w.zipf = rand.NewZipf(w.rnd, 1.1, 1, uint64(opts.Keys-1))
+			} else {
+				w.keys = opts.Keys
+			}
+			results[i] = w.result
+			for {
+				n := int64(opts.Pipeline)
+				end := atomic.AddInt64(&sent, n)
+				if end-n >= int64(opts.Requests) {
+					return
+				}
+				if end > int64(opts.Requests) {
+					n -= end - int64(opts.Requests)
+				}
+				errs[i] = w.batch(int(n))
+				if errs[i] != nil {
+					return
+				}
+			}
+		}(i, client)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	total := newBenchResult()
+	for _, result := range results {
+		total.merge(result)
+	}
+	total.print(elapsed)
+	return nil
+}
+
+// parseMix parses "op=weight,..." into the weight of each op, in the order of
+// benchOps.
+func parseMix(mix string) ([]int, error) {
+	weights := make([]int, len(benchOps))
+	sum := 0
+	for _, part := range strings.Split(mix, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid mix '%s', expected op=weight", part)
+		}
+		i := indexOf(benchOps, kv[0])
+		if i < 0 {
+			return nil, fmt.Errorf("Unknown op '%s' in mix", kv[0])
+		}
+		w, err := strconv.Atoi(kv[1])
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("Invalid weight '%s' in mix", kv[1])
+		}
+		weights[i] = w
+		sum += w
+	}
+	if sum == 0 {
+		return nil, fmt.Errorf("The mix needs at least one op")
+	}
+	return weights, nil
+}
+
+func indexOf(list []string, s string) int {
+	for i, item := range list {
+		if item == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// benchWorker sends ops down one connection.
+type benchWorker struct {
+	client  *Client
+	rnd     *rand.Rand
+	zipf    *rand.Zipf
+	keys    int
+	weights []int
+	prefix  string
+	data    string
+	result  *benchResult
+}
+
+// batch sends n ops then reads their replies, recording how long each took.
+func (w *benchWorker) batch(n int) error {
+	ops := make([]int, n)
+	args := make([][]string, n)
+	for i := range ops {
+		ops[i] = w.op()
+		args[i] = w.args(ops[i])
+	}
+
+	// the clock starts before the first send, since a long batch is flushed as
+	// the buffer fills, before its replies are received
+	start := time.Now()
+	for _, a := range args {
+		w.client.Send(a...)
+	}
+	err := w.client.Flush()
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		reply, err := w.client.Receive()
+		if err != nil {
+			return err
+		}
+		_, failed := reply.(ReplyError)
+		w.result.add(op, time.Since(start), failed)
+	}
+	return nil
+}
+
+// op picks an op according to the weights.
+func (w *benchWorker) op() int {
+	sum := 0
+	for _, weight := range w.weights {
+		sum += weight
+	}
+	n := w.rnd.Intn(sum)
+	for i, weight := range w.weights {
+		if n < weight {
+			return i
+		}
+		n -= weight
+	}
+	return len(w.weights) - 1
+}
+
+func (w *benchWorker) key() string {
+	var n uint64
+	if w.zipf != nil {
+		n = w.zipf.Uint64()
+	} else {
+		n = uint64(w.rnd.Intn(w.keys))
+	}
+	return w.prefix + strconv.FormatUint(n, 10)
+}
+
+func (w *benchWorker) args(op int) []string {
+	key := w.key()
+	switch benchOps[op] {
+	case "put":
+		return []string{"put", key, `{"n":` + strconv.Itoa(w.rnd.Intn(1000)) + `,"data":"` + w.data + `"}`}
+	case "inc":
+		return []string{"inc", key, "n"}
+	case "incby":
+		return []string{"incby", key, "n", strconv.Itoa(w.rnd.Intn(10) + 1)}
+	case "del":
+		return []string{"del", key}
+	}
+	return []string{"get", key}
+}
+
+// benchResult holds the latency of every op sent, by op.
+type benchResult struct {
+	latencies [][]time.Duration
+	errors    []int
+}
+
+func newBenchResult() *benchResult {
+	return &benchResult{
+		latencies: make([][]time.Duration, len(benchOps)),
+		errors:    make([]int, len(benchOps)),
+	}
+}
+
+func (r *benchResult) add(op int, latency time.Duration, failed bool) {
+	r.latencies[op] = append(r.latencies[op], latency)
+	if failed {
+		r.errors[op]++
+	}
+}
+
+func (r *benchResult) merge(other *benchResult) {
+	for op := range benchOps {
+		r.latencies[op] = append(r.latencies[op], other.latencies[op]...)
+		r.errors[op] += other.errors[op]
+	}
+}
+
+func (r *benchResult) print(elapsed time.Duration) {
+	fmt.Printf("%-6s %10s %8s %12s %9s %9s %9s %9s %9s\n", "op", "count", "errors", "ops/sec", "p50", "p90", "p99", "p99.9", "max")
+
+	var all []time.Duration
+	errors := 0
+	for op, name := range benchOps {
+		if len(r.latencies[op]) == 0 {
+			continue
+		}
+		printLatencies(name, r.latencies[op], r.errors[op], elapsed)
+		all = append(all, r.latencies[op]...)
+		errors += r.errors[op]
+	}
+	printLatencies("all", all, errors, elapsed)
+
+	fmt.Printf("\n%d ops in %.2fs\n", len(all), elapsed.Seconds())
+}
+
+func printLatencies(name string, latencies []time.Duration, errors int, elapsed time.Duration) {
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	rate := float64(len(latencies)) / elapsed.Seconds()
+	fmt.Printf("%-6s %10d %8d %12.0f %9s %9s %9s %9s %9s\n", name, len(latencies), errors, rate,
+		formatLatency(percentile(latencies, 0.50)),
+		formatLatency(percentile(latencies, 0.90)),
+		formatLatency(percentile(latencies, 0.99)),
+		formatLatency(percentile(latencies, 0.999)),
+		formatLatency(latencies[len(latencies)-1]),
+	)
+}
+
+// percentile returns the latency which q of the sorted latencies are at or
+// under.
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+func formatLatency(d time.Duration) string {
+	return fmt.Sprintf("%.3fms", float64(d)/float64(time.Millisecond))
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+// cliCommand is a server command the cli knows about, with its usage in the
+// same form as the server's own. The usage is used for help, to complete
+// subcommands and keywords, and to find which arguments must be JSON.
+type cliCommand struct {
+	name   string
+	usages []string
+}
+
+var cliCommands = []cliCommand{
+	{"ping", []string{"ping"}},
+	{"time", []string{"time"}},
+	{"id", []string{"id"}},
+	{"put", []string{"put <key> <json> [EX <seconds>]"}},
+	{"expire", []string{"expire <key> <seconds>"}},
+	{"inc", []string{"inc <key> <field...>"}},
+	{"incby", []string{"incby <key> <field> <count> [<field> <count>...]"}},
+	{"del", []string{"del <key> [json]"}},
+	{"max", []string{"max <key> <field> <number>"}},
+	{"min", []string{"min <key> <field> <number>"}},
+	{"mvset", []string{"mvset <key> <field> <json> [<seen-id>...]"}},
+	{"resolve", []string{"resolve <key> <field> <json>"}},
+	{"textins", []string{"textins <key> <field> <pos-id> <string>"}},
+	{"textdel", []string{"textdel <key> <field> <char-id...>"}},
+	{"textids", []string{"textids <key> <field>"}},
+	{"get", []string{"get <key> [AT <timestamp|op-id>]"}},
+	{"schema", []string{
+		"schema set <prefix> <json>",
+		"schema get <prefix>",
+		"schema del <prefix>",
+		"schema list",
+	}},
+	{"mget", []string{"mget <key> [<key>...]"}},
+	{"exists", []string{"exists <key> [<key>...]"}},
+	{"scan", []string{"scan <cursor> [MATCH <pattern>] [COUNT <n>] [AT <timestamp|op-id>]"}},
+	{"range", []string{"range <start> <end> [limit] [reverse] [AT <timestamp|op-id>]"}},
+	{"history", []string{"history <key> [since-id] [limit]"}},
+	{"subscribe", []string{"subscribe <key...> [SINCE <op-id>]"}},
+	{"psubscribe", []string{"psubscribe <pattern...> [SINCE <op-id>]"}},
+	{"index", []string{
+		"index create <name> <key-prefix> <json-path>",
+		"index query <name> <value> | <min> <max>",
+		"index drop <name>",
+		"index list",
+	}},
+	{"view", []string{
+		"view create <name> <key-prefix> <[group-path=]value-path> sum|count|max",
+		"view get <name> [<group>]",
+		"view top <name> [<n>]",
+		"view drop <name>",
+		"view list",
+	}},
+	{"query", []string{"query <prefix> [WHERE <expr>] [FIELDS <path,...>] [LIMIT <n>]"}},
+	{"aggregate", []string{"aggregate <prefix> count|sum|min|max|avg <json-path> [GROUP BY <path>]"}},
+	{"signature", []string{"signature <key>"}},
+	{"backup", []string{"backup <name> [since-op-id]"}},
+	{"dump", []string{"dump [log|data] [prefix] [CURSOR <cursor>] [COUNT <n>]"}},
+	{"quit", []string{"quit"}},
+}
+
+func CmdHelpCli(msg string) error {
+	if msg != "" {
+		fmt.Printf("Error: %s\n\n", msg)
+	}
+	fmt.Println("Talk to a MoDB server. With no command given and a terminal on stdin, this")
+	fmt.Println("starts an interactive prompt with history and tab completion, where JSON")
+	fmt.Println("replies are pretty-printed. Type 'help' at the prompt for the commands.")
+	fmt.Println("")
+	fmt.Println("Otherwise the command given, or each line of stdin, is run in turn and the")
+	fmt.Println("replies printed plainly, one value per line, for use in scripts. Any error")
+	fmt.Println("reply makes the cli exit non-zero.")
+	fmt.Println("")
+	fmt.Println("Arguments which the command takes as JSON are checked before being sent.")
+	fmt.Println("Arguments may be quoted with single or double quotes, as in a shell.")
+	fmt.Println("")
+	fmt.Println("Usage:")
+	fmt.Println("")
+	fmt.Println("  modb cli [flags] [command [args...]]")
+	fmt.Println("")
+	fmt.Println("Flags:")
+	fmt.Println("")
+	fmt.Println("  -h, --help")
+	fmt.Println("        help for cli")
+	fmt.Println("")
+	fmt.Println("  --host")
+	fmt.Println("        host of the server (default: localhost)")
+	fmt.Println("")
+	fmt.Println("  --port")
+	fmt.Println("        port of the server (default: 29876)")
+	fmt.Println("")
+	fmt.Println("Use 'modb help [command]' for more information about a command.")
+	return nil
+}
+
+func CmdCli(opts Opts) error {
+	if opts.Help == true {
+		return CmdHelpCli("")
+	}
+
+	addr := opts.Host + ":" + strconv.Itoa(opts.Port)
+	client, err := Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		client.Close()
+	}()
+
+	if opts.Pathname == "" && isTerminal(int(os.Stdin.Fd())) {
+		return repl(addr, &client)
+	}
+
+	if opts.Pathname != "" {
+		args := append([]string{opts.Pathname}, opts.Args...)
+		ok, err := runCommand(client, args, os.Stdout)
+		if err == nil && !ok {
+			err = fmt.Errorf("%s failed", args[0])
+		}
+		return err
+	}
+
+	return runScript(client, os.Stdin, os.Stdout)
+}
+
+// runScript runs each line of r as a command as soon as it's read, so that a
+// script piped in a line at a time is answered a line at a time, printing the
+// replies plainly. It fails if any command was invalid or had an error reply.
+func runScript(client *Client, r io.Reader, w io.Writer) error {
+	failed := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLine)
+	for n := 1; scanner.Scan(); n++ {
+		args, err := splitLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("line %d: %s", n, err)
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		ok, err := runCommand(client, args, w)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			failed++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d commands failed", failed)
+	}
+	return nil
+}
+
+// runCommand runs one command, printing its reply plainly, and reports whether
+// it was valid and had no error reply. The error is kept for failures of the
+// connection itself. A subscribe carries on printing messages until then.
+func runCommand(client *Client, args []string, w io.Writer) (bool, error) {
+	err := checkArgs(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", args[0], err)
+		return false, nil
+	}
+
+	reply, err := client.Do(args...)
+	if err != nil {
+		return false, err
+	}
+	ok := writePlain(w, reply)
+
+	if isSubscribe(args[0]) {
+		for {
+			reply, err := client.Receive()
+			if err != nil {
+				return ok, err
+			}
+			writePlain(w, reply)
+		}
+	}
+	return ok, nil
+}
+
+// repl runs the interactive prompt until Ctrl-D, `exit` or `quit`, replacing
+// the client with a new connection whenever the old one can't be used.
+func repl(addr string, client **Client) error {
+	editor := newLineEditor(os.Stdin, os.Stdout, completeCli)
+	historyFile := ""
+	if home := os.Getenv("HOME"); home != "" {
+		historyFile = filepath.Join(home, ".modb_history")
+		if err := editor.LoadHistory(historyFile); err != nil {
+			log.Printf("Couldn't read history: %s", err)
+		}
+	}
+	defer func() {
+		if historyFile == "" {
+			return
+		}
+		if err := editor.SaveHistory(historyFile); err != nil {
+			log.Printf("Couldn't save history: %s", err)
+		}
+	}()
+
+	for {
+		line, err := editor.ReadLine(addr + "> ")
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		args, err := splitLine(line)
+		if err != nil {
+			fmt.Printf("(error) %s\n", err)
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		name := strings.ToLower(args[0])
+		switch name {
+		case "exit", "quit":
+			return nil
+		case "help":
+			printCliHelp(args[1:])
+			continue
+		}
+
+		err = checkArgs(args)
+		if err != nil {
+			fmt.Printf("(error) %s\n", err)
+			continue
+		}
+
+		reply, err := (*client).Do(args...)
+		if err == nil {
+			fmt.Println(formatReply(reply, ""))
+			if isSubscribe(name) {
+				err = follow(*client)
+			}
+		}
+		if err != nil {
+			// start again with a new connection, whatever state the old one was in
+			(*client).Close()
+			if err != io.EOF {
+				fmt.Printf("(error) %s\n", err)
+			}
+			*client, err = Dial(addr)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// follow prints the messages of a subscription until Ctrl-C, after which the
+// connection can't be used for anything else and io.EOF is returned.
+func follow(client *Client) error {
+	fmt.Println("Following, press Ctrl-C to stop ...")
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	defer signal.Stop(stop)
+	go func() {
+		if _, ok := <-stop; ok {
+			client.Close()
+		}
+	}()
+
+	for {
+		reply, err := client.Receive()
+		if err != nil {
+			return io.EOF
+		}
+		fmt.Println(formatReply(reply, ""))
+	}
+}
+
+func isSubscribe(name string) bool {
+	name = strings.ToLower(name)
+	return name == "subscribe" || name == "psubscribe"
+}
+
+func findCliCommand(name string) *cliCommand {
+	for i := range cliCommands {
+		if strings.EqualFold(cliCommands[i].name, name) {
+			return &cliCommands[i]
+		}
+	}
+	return nil
+}
+
+func printCliHelp(names []string) {
+	if len(names) == 0 {
+		for _, cmd := range cliCommands {
+			for _, usage := range cmd.usages {
+				fmt.Println(usage)
+			}
+		}
+		fmt.Println("help [command]")
+		fmt.Println("exit")
+		return
+	}
+
+	for _, name := range names {
+		cmd := findCliCommand(name)
+		if cmd == nil {
+			fmt.Printf("(error) unknown command '%s'\n", name)
+			continue
+		}
+		for _, usage := range cmd.usages {
+			fmt.Println(usage)
+		}
+	}
+}
+
+// usageWords returns the words of a usage after the command itself.
+func usageWords(usage string) []string {
+	return strings.Fields(usage)[1:]
+}
+
+// literal returns the alternatives for a word of a usage which must be given
+// as it is, or nil if the word is optional or a placeholder.
+func literal(word string) []string {
+	if strings.ContainsAny(word, "<>[]") || strings.HasSuffix(word, "...") {
+		return nil
+	}
+	return strings.Split(word, "|")
+}
+
+// usageMatches reports whether the arguments match the words of the usage
+// which must be given as they are, up to the first optional word.
+func usageMatches(usage string, args []string) bool {
+	for i, word := range usageWords(usage) {
+		if i >= len(args) || strings.HasPrefix(word, "[") || word == "|" {
+			break
+		}
+		alts := literal(word)
+		if alts == nil {
+			continue
+		}
+		found := false
+		for _, alt := range alts {
+			if strings.EqualFold(alt, args[i]) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// checkArgs makes sure every argument which the command takes as JSON is JSON.
+func checkArgs(args []string) error {
+	cmd := findCliCommand(args[0])
+	if cmd == nil {
+		return nil
+	}
+
+	for _, usage := range cmd.usages {
+		if !usageMatches(usage, args[1:]) {
+			continue
+		}
+		for i, word := range usageWords(usage) {
+			if strings.Trim(word, "[]<>") != "json" || i+1 >= len(args) {
+				continue
+			}
+			if err := fastjson.Validate(args[i+1]); err != nil {
+				return fmt.Errorf("argument %d is not valid JSON: %s", i+1, err)
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// completeCli returns the commands, subcommands or keywords which could finish
+// the partial word.
+func completeCli(words []string, partial string) []string {
+	var all []string
+	if len(words) == 0 {
+		for _, cmd := range cliCommands {
+			all = append(all, cmd.name)
+		}
+		all = append(all, "help", "exit")
+	} else if strings.EqualFold(words[0], "help") {
+		if len(words) == 1 {
+			for _, cmd := range cliCommands {
+				all = append(all, cmd.name)
+			}
+		}
+	} else if cmd := findCliCommand(words[0]); cmd != nil {
+		args := words[1:]
+		for _, usage := range cmd.usages {
+			if !usageMatches(usage, args) {
+				continue
+			}
+			usage := usageWords(usage)
+			if len(args) < len(usage) {
+				all = append(all, literal(usage[len(args)])...)
+			}
+			// keywords may come anywhere after the start
+			for _, word := range usage {
+				keyword := strings.Trim(word, "[]")
+				if keyword != "" && strings.ToUpper(keyword) == keyword && literal(keyword) != nil {
+					all = append(all, keyword)
+				}
+			}
+		}
+	}
+
+	seen := map[string]bool{}
+	var candidates []string
+	for _, word := range all {
+		if !seen[word] && len(word) >= len(partial) && strings.EqualFold(word[:len(partial)], partial) {
+			seen[word] = true
+			candidates = append(candidates, word)
+		}
+	}
+	sort.Strings(candidates)
+	return candidates
+}
+
+// splitLine splits a line into arguments on spaces, as a shell would, where
+// single quotes keep everything inside as it is and double quotes allow
+// backslash escapes.
+func splitLine(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		case c == '\'':
+			j := strings.IndexByte(line[i+1:], '\'')
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			arg.WriteString(line[i+1 : i+1+j])
+			i += j + 1
+			inArg = true
+		case c == '"':
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				arg.WriteByte(line[i])
+			}
+			if i == len(line) {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			inArg = true
+		case c == '\\' && i+1 < len(line):
+			i++
+			arg.WriteByte(line[i])
+			inArg = true
+		default:
+			arg.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// formatReply formats a reply for people to read, in the style of redis-cli,
+// with JSON pretty-printed.
+func formatReply(reply interface{}, indent string) string {
+	switch r := reply.(type) {
+	case Status:
+		return string(r)
+	case ReplyError:
+		return "(error) " + string(r)
+	case int64:
+		return "(integer) " + strconv.FormatInt(r, 10)
+	case nil:
+		return "(nil)"
+	case string:
+		if len(r) > 0 && (r[0] == '{' || r[0] == '[') && fastjson.Validate(r) == nil {
+			var b bytes.Buffer
+			if json.Indent(&b, []byte(r), indent, "  ") == nil {
+				return b.String()
+			}
+		}
+		return strconv.Quote(r)
+	case []interface{}:
+		if len(r) == 0 {
+			return "(empty array)"
+		}
+		width := len(strconv.Itoa(len(r)))
+		var lines []string
+		for i, item := range r {
+			num := fmt.Sprintf("%*d) ", width, i+1)
+			inner := indent + strings.Repeat(" ", len(num))
+			line := num + formatReply(item, inner)
+			if i > 0 {
+				line = indent + line
+			}
+			lines = append(lines, line)
+		}
+		return strings.Join(lines, "\n")
+	}
+	return fmt.Sprintf("%v", reply)
+}
+
+// writePlain writes a reply with each value on a line of its own, and any error
+// to stderr, reporting whether it wasn't an error.
+func writePlain(w io.Writer, reply interface{}) bool {
+	switch r := reply.(type) {
+	case ReplyError:
+		fmt.Fprintln(os.Stderr, string(r))
+		return false
+	case []interface{}:
+		ok := true
+		for _, item := range r {
+			if !writePlain(w, item) {
+				ok = false
+			}
+		}
+		return ok
+	case nil:
+		fmt.Fprintln(w)
+	default:
+		fmt.Fprintln(w, r)
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunScriptStreams(t *testing.T) {
+	client := testServer(t)
+	in, script := io.Pipe()
+	out, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- runScript(client, in, w)
+		w.Close()
+	}()
+
+	// each reply must arrive before the next line is written
+	lines := bufio.NewReader(out)
+	for _, step := range [][2]string{
+		{`put k '{"n":1}'`, "OK"},
+		{"inc k n", "OK"},
+		{"get k", `{"n":2}`},
+	} {
+		if _, err := io.WriteString(script, step[0]+"\n"); err != nil {
+			t.Fatal(err)
+		}
+		got := make(chan string, 1)
+		go func() {
+			line, _ := lines.ReadString('\n')
+			got <- strings.TrimSpace(line)
+		}()
+		select {
+		case line := <-got:
+			if line != step[1] {
+				t.Errorf("%s gave %q, want %q", step[0], line, step[1])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no reply to %s before the script ended", step[0])
+		}
+	}
+
+	script.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/modb-dev/modb/store"
+)
+
+func CmdHelpDiff(msg string) error {
+	if msg != "" {
+		fmt.Printf("Error: %s\n\n", msg)
+	}
+	fmt.Println("Compare two local datastores key by key using their signatures, and for each")
+	fmt.Println("key which differs list the ops found on only one side, or which have the same")
+	fmt.Println("id but differ. Neither datastore should be in use by a server.")
+	fmt.Println("")
+	fmt.Println("With --out, every op found on only one side is also written to a patch in the")
+	fmt.Println("format of 'modb dump'. Loading the patch into both datastores with 'modb load'")
+	fmt.Println("brings them back in step, since ops already present are skipped.")
+	fmt.Println("")
+	fmt.Println("Usage:")
+	fmt.Println("")
+	fmt.Println("  modb diff [flags] <type>:<path> <type>:<path>")
+	fmt.Println("")
+	fmt.Println("Flags:")
+	fmt.Println("")
+	fmt.Println("  -h, --help")
+	fmt.Println("        help for diff")
+	fmt.Println("")
+	fmt.Println("  --out")
+	fmt.Println("        file to write the patch to")
+	fmt.Println("")
+	fmt.Println("Use 'modb help [command]' for more information about a command.")
+	return nil
+}
+
+func CmdDiff(opts Opts) error {
+	if opts.Help == true {
+		return CmdHelpDiff("")
+	}
+
+	if len(opts.Args) != 1 {
+		return CmdHelpDiff("Provide two datastores to compare")
+	}
+	nameA, nameB := opts.Pathname, opts.Args[0]
+	typeA, pathA, ok := splitStore(nameA)
+	if !ok {
+		return CmdHelpDiff("Provide each datastore as <type>:<path>")
+	}
+	typeB, pathB, ok := splitStore(nameB)
+	if !ok {
+		return CmdHelpDiff("Provide each datastore as <type>:<path>")
+	}
+
+	log.Println("MoDB Started")
+	defer log.Println("MoDB Finished")
+
+	// Datastores
+	a, err := NewStore(typeA, pathA)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		log.Println("Closing Datastore " + nameA)
+		a.Close()
+	}()
+
+	b, err := NewStore(typeB, pathB)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		log.Println("Closing Datastore " + nameB)
+		b.Close()
+	}()
+
+	var patch *bufio.Writer
+	if opts.Out != "" {
+		f, err := os.Create(opts.Out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		patch = bufio.NewWriter(f)
+	}
+
+	log.Println("Comparing signatures ...")
+	var keys []string
+	checked, mismatched, err := compareSignatures(a, b, func(key, sigA, sigB string) {
+		keys = append(keys, key)
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(keys) > 0 {
+		fmt.Printf("A: %s\nB: %s\n\n", nameA, nameB)
+	}
+	ops := 0
+	for _, key := range keys {
+		n, err := diffKey(a, b, key, os.Stdout, patch)
+		if err != nil {
+			return err
+		}
+		ops += n
+	}
+	if patch != nil {
+		err := patch.Flush()
+		if err != nil {
+			return err
+		}
+		log.Printf("Wrote %d ops to %s\n", ops, opts.Out)
+	}
+
+	log.Printf("Checked %d keys\n", checked)
+	if mismatched > 0 {
+		return fmt.Errorf("%d keys differ", mismatched)
+	}
+
+	return nil
+}
+
+// diffKey writes out how the key's ledger differs between two datastores, and
+// any ops found on only one side to patch, if given, returning how many.
+func diffKey(a, b store.Storage, key string, w io.Writer, patch io.Writer) (int, error) {
+	changesA, err := changesById(a, key)
+	if err != nil {
+		return 0, err
+	}
+	changesB, err := changesById(b, key)
+	if err != nil {
+		return 0, err
+	}
+
+	var ids []string
+	for id := range changesA {
+		ids = append(ids, id)
+	}
+	for id := range changesB {
+		if _, ok := changesA[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	fmt.Fprintf(w, "%s: %d ops in A, %d ops in B\n", key, len(changesA), len(changesB))
+	n := 0
+	for _, id := range ids {
+		changeA, inA := changesA[id]
+		changeB, inB := changesB[id]
+		var missing store.Change
+		switch {
+		case !inB:
+			fmt.Fprintf(w, "  only in A  %s  %s %s\n", id, changeA.Op, changeA.Diff)
+			missing = changeA
+		case !inA:
+			fmt.Fprintf(w, "  only in B  %s  %s %s\n", id, changeB.Op, changeB.Diff)
+			missing = changeB
+		case changeA != changeB:
+			fmt.Fprintf(w, "  differs    %s  %s %s != %s %s\n", id, changeA.Op, changeA.Diff, changeB.Op, changeB.Diff)
+			continue
+		default:
+			continue
+		}
+
+		if patch != nil {
+			_, err := fmt.Fprintln(patch, missing.JSON())
+			if err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+	return n, nil
+}
+
+// changesById returns each of the key's changes by its op id.
+func changesById(db store.Storage, key string) (map[string]store.Change, error) {
+	changes := map[string]store.Change{}
+	err := db.IterateChanges(key, func(change store.Change) {
+		changes[change.Id] = change
+	})
+	return changes, err
+}
@@ -1,19 +1,37 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"strings"
+
+	"github.com/modb-dev/modb/store"
+	"github.com/valyala/fastjson"
 )
 
 func CmdHelpDump(msg string) error {
 	if msg != "" {
 		fmt.Printf("Error: %s\n\n", msg)
 	}
-	fmt.Println("Dump a local datastore to stdout.")
+	fmt.Println("Dump a local datastore to stdout, one JSON object per line. The datastore")
+	fmt.Println("shouldn't be in use by a server whilst it is dumped.")
+	fmt.Println("")
+	fmt.Println("Log entries are dumped first, in the order they are stored, which is by")
+	fmt.Println("\"<key>:<op-id>\" (so \"user:10\" comes before \"user:1\"), as:")
+	fmt.Println("")
+	fmt.Println(`  {"key":"<key>","id":"<op-id>","op":"<op>","diff":<json>}`)
+	fmt.Println("")
+	fmt.Println("Then data entries, in key order, as:")
+	fmt.Println("")
+	fmt.Println(`  {"key":"<key>","data":<json>}`)
 	fmt.Println("")
 	fmt.Println("Usage:")
 	fmt.Println("")
-	fmt.Println("  modb dump [fileOrDirName]")
+	fmt.Println("  modb dump [flags] [fileOrDirName]")
 	fmt.Println("")
 	fmt.Println("Flags:")
 	fmt.Println("")
@@ -21,7 +39,19 @@ func CmdHelpDump(msg string) error {
 	fmt.Println("        help for dump")
 	fmt.Println("")
 	fmt.Println("  -d, --datastore")
-	fmt.Println("        path to datastore")
+	fmt.Println("        type of datastore: bbolt, badger, level (default: bbolt)")
+	fmt.Println("")
+	fmt.Println("  --out")
+	fmt.Println("        file to write to instead of stdout")
+	fmt.Println("")
+	fmt.Println("  --prefix")
+	fmt.Println("        only dump keys starting with this prefix")
+	fmt.Println("")
+	fmt.Println("  --log-only")
+	fmt.Println("        only dump the log")
+	fmt.Println("")
+	fmt.Println("  --data-only")
+	fmt.Println("        only dump the data")
 	fmt.Println("")
 	fmt.Println("Use 'modb help [command]' for more information about a command.")
 	return nil
@@ -29,15 +59,19 @@ func CmdHelpDump(msg string) error {
 
 func CmdDump(opts Opts) error {
 	if opts.Help == true {
-		return CmdHelpServer("")
+		return CmdHelpDump("")
 	}
 
 	if opts.Pathname == "" {
 		return CmdHelpDump("Provide a path for your datastore")
 	}
 
+	if opts.LogOnly && opts.DataOnly {
+		return CmdHelpDump("Use only one of --log-only and --data-only")
+	}
+
 	log.Println("MoDB Started")
-	defer log.Println("MoDB Finished\n")
+	defer log.Println("MoDB Finished")
 
 	// Datastore
 	db, err := NewStore(opts.Datastore, opts.Pathname)
@@ -49,8 +83,92 @@ func CmdDump(opts Opts) error {
 		db.Close()
 	}()
 
-	// ToDo
+	var out io.Writer = os.Stdout
+	if opts.Out != "" {
+		f, err := os.Create(opts.Out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+
 	log.Println("Dumping datastore ...")
+	n, err := dump(db, w, opts.Prefix, !opts.DataOnly, !opts.LogOnly)
+	if err != nil {
+		return err
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	log.Printf("Dumped %d entries\n", n)
 
 	return nil
 }
+
+// dump writes the log and/or data entries for keys starting with prefix to w
+// as JSON lines, returning how many were written. Log entries which can't be
+// parsed, or whose diff isn't JSON, are skipped with a warning, since
+// `modb verify` is there for those.
+func dump(db store.Storage, w io.Writer, prefix string, logs, data bool) (int, error) {
+	n := 0
+	var writeErr error
+
+	if logs {
+		err := db.IterateLog(prefix, func(k, v string) bool {
+			if !strings.HasPrefix(k, prefix) {
+				return false
+			}
+			change, err := store.ParseLogEntry(k, v)
+			if err != nil {
+				log.Printf("Skipping %s", err)
+				return true
+			}
+			if fastjson.Validate(change.Diff) != nil {
+				log.Printf("Skipping log entry '%s' with an invalid diff", k)
+				return true
+			}
+			_, writeErr = fmt.Fprintln(w, change.JSON())
+			n++
+			return writeErr == nil
+		})
+		if err != nil {
+			return n, err
+		}
+		if writeErr != nil {
+			return n, writeErr
+		}
+	}
+
+	if data {
+		err := db.IterateData(prefix, func(k, v string) bool {
+			if !strings.HasPrefix(k, prefix) {
+				return false
+			}
+			_, writeErr = fmt.Fprintln(w, dataJSON(k, v))
+			n++
+			return writeErr == nil
+		})
+		if err != nil {
+			return n, err
+		}
+		if writeErr != nil {
+			return n, writeErr
+		}
+	}
+
+	return n, nil
+}
+
+// dataJSON returns a data entry as {"key", "data"}, where the data is left as
+// it is if it's JSON, and made into a string if not.
+func dataJSON(key, val string) string {
+	k, _ := json.Marshal(key)
+	if fastjson.Validate(val) != nil {
+		b, _ := json.Marshal(val)
+		val = string(b)
+	}
+	return `{"key":` + string(k) + `,"data":` + val + `}`
+}
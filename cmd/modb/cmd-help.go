@@ -10,6 +10,33 @@ func CmdHelp(msg string, opts Opts) error {
 		if opts.Command == "server" {
 			CmdHelpServer(msg)
 		}
+		if opts.Command == "dump" {
+			CmdHelpDump(msg)
+		}
+		if opts.Command == "load" {
+			CmdHelpLoad(msg)
+		}
+		if opts.Command == "migrate" {
+			CmdHelpMigrate(msg)
+		}
+		if opts.Command == "restore" {
+			CmdHelpRestore(msg)
+		}
+		if opts.Command == "verify" {
+			CmdHelpVerify(msg)
+		}
+		if opts.Command == "cli" {
+			CmdHelpCli(msg)
+		}
+		if opts.Command == "bench" {
+			CmdHelpBench(msg)
+		}
+		if opts.Command == "inspect" {
+			CmdHelpInspect(msg)
+		}
+		if opts.Command == "diff" {
+			CmdHelpDiff(msg)
+		}
 
 		return nil
 	}
@@ -27,6 +54,14 @@ func CmdHelp(msg string, opts Opts) error {
 	fmt.Println("")
 	fmt.Println("  server      start a server")
 	fmt.Println("  dump        dump a database")
+	fmt.Println("  load        load a dump into a database")
+	fmt.Println("  migrate     copy a database into another")
+	fmt.Println("  restore     restore a database from backups")
+	fmt.Println("  verify      check a database for bad entries")
+	fmt.Println("  cli         talk to a server")
+	fmt.Println("  bench       benchmark a server")
+	fmt.Println("  inspect     show everything about a key")
+	fmt.Println("  diff        compare two databases")
 	fmt.Println("  help        Help about any command")
 	fmt.Println("")
 	fmt.Println("Flags:")
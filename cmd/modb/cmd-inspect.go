@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/modb-dev/modb/store"
+)
+
+func CmdHelpInspect(msg string) error {
+	if msg != "" {
+		fmt.Printf("Error: %s\n\n", msg)
+	}
+	fmt.Println("Print everything a local datastore holds about one key: each op in its log,")
+	fmt.Println("with the document as it stood after that op, then the stored data entry and")
+	fmt.Println("the key's signature. The datastore shouldn't be in use by a server.")
+	fmt.Println("")
+	fmt.Println("Usage:")
+	fmt.Println("")
+	fmt.Println("  modb inspect [flags] [fileOrDirName] [key]")
+	fmt.Println("")
+	fmt.Println("Flags:")
+	fmt.Println("")
+	fmt.Println("  -h, --help")
+	fmt.Println("        help for inspect")
+	fmt.Println("")
+	fmt.Println("  -d, --datastore")
+	fmt.Println("        type of datastore: bbolt, badger, level (default: bbolt)")
+	fmt.Println("")
+	fmt.Println("Use 'modb help [command]' for more information about a command.")
+	return nil
+}
+
+func CmdInspect(opts Opts) error {
+	if opts.Help == true {
+		return CmdHelpInspect("")
+	}
+
+	if opts.Pathname == "" {
+		return CmdHelpInspect("Provide a path for your datastore")
+	}
+
+	if len(opts.Args) != 1 {
+		return CmdHelpInspect("Provide the key to inspect")
+	}
+
+	log.Println("MoDB Started")
+	defer log.Println("MoDB Finished")
+
+	// Datastore
+	db, err := NewStore(opts.Datastore, opts.Pathname)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		log.Println("Closing Datastore")
+		db.Close()
+	}()
+
+	return inspect(db, os.Stdout, opts.Args[0])
+}
+
+// inspect writes out the key's ledger, replaying it an op at a time, followed
+// by its data entry and signature.
+func inspect(db store.Storage, w io.Writer, key string) error {
+	var changes []store.Change
+	err := db.IterateChanges(key, func(change store.Change) {
+		changes = append(changes, change)
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Key: %s\n", key)
+	fmt.Fprintf(w, "Ops: %d\n", len(changes))
+
+	doc := store.NewDoc()
+	var good []store.Change
+	for _, change := range changes {
+		when := "invalid id"
+		t, timeErr := store.IdTime(change.Id)
+		if timeErr == nil {
+			when = t.UTC().Format(time.RFC3339Nano)
+		}
+		fmt.Fprintf(w, "\n%s  %s\n", change.Id, when)
+		fmt.Fprintf(w, "  %-8s %s\n", change.Op, change.Diff)
+
+		err := doc.Apply(change)
+		if err != nil {
+			fmt.Fprintf(w, "  error    %s\n", err)
+			// start again, since the failed change may have been half applied
+			doc, _ = store.Replay(good)
+			continue
+		}
+		good = append(good, change)
+		// as it was once the op was written, rather than as it is now
+		deleted := doc.Deleted()
+		if timeErr == nil {
+			deleted = doc.DeletedAt(t)
+		}
+		if deleted {
+			fmt.Fprintf(w, "  =>       (deleted)\n")
+		} else {
+			fmt.Fprintf(w, "  =>       %s\n", doc.String())
+		}
+	}
+
+	fmt.Fprintln(w)
+	switch {
+	case len(changes) == 0:
+		fmt.Fprintf(w, "Document:  (none)\n")
+	case doc.Deleted():
+		fmt.Fprintf(w, "Document:  (deleted)\n")
+	default:
+		fmt.Fprintf(w, "Document:  %s\n", doc.String())
+	}
+	if expires := doc.Expires(); !expires.IsZero() {
+		fmt.Fprintf(w, "Expires:   %s\n", expires.UTC().Format(time.RFC3339Nano))
+	}
+
+	data := ""
+	found := false
+	err = db.IterateData(key, func(k, v string) bool {
+		if k == key {
+			data, found = v, true
+		}
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	if found {
+		fmt.Fprintf(w, "Data:      %s\n", data)
+	} else {
+		fmt.Fprintf(w, "Data:      (none)\n")
+	}
+
+	sig, err := signature(db, key)
+	if err != nil {
+		return err
+	}
+	if sig == "" {
+		sig = "(none)"
+	}
+	fmt.Fprintf(w, "Signature: %s\n", sig)
+
+	return nil
+}
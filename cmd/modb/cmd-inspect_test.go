@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/modb-dev/modb/store"
+)
+
+func TestInspectBadChange(t *testing.T) {
+	db := testStore(t)
+	at := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var list []store.Change
+	for i, op := range [][2]string{
+		{"put", `{"n":1}`},
+		{"del", `{}`},
+		// fails once the document has been touched, having no field
+		{"mvset", `{"value":1}`},
+	} {
+		id := store.IdAt(at.Add(time.Duration(i) * time.Second))
+		list = append(list, store.Change{Key: "k", Id: id, Op: op[0], Diff: op[1]})
+	}
+	if _, err := db.Append(list); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := inspect(db, &b, "k"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "error    change") {
+		t.Errorf("the bad change wasn't reported:\n%s", b.String())
+	}
+	if !strings.Contains(b.String(), "Document:  (deleted)") {
+		t.Errorf("the document should be deleted, as verify has it:\n%s", b.String())
+	}
+
+	_, problems, err := verify(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 {
+		t.Errorf("verify found %d problems, want 1", len(problems))
+	}
+}
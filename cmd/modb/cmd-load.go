@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/modb-dev/modb/store"
+)
+
+// loadBatch is how many ops, or data entries, are written to the datastore at a
+// time.
+const loadBatch = 1000
+
+// maxLine is the longest line accepted from a dump.
+const maxLine = 64 * 1024 * 1024
+
+func CmdHelpLoad(msg string) error {
+	if msg != "" {
+		fmt.Printf("Error: %s\n\n", msg)
+	}
+	fmt.Println("Load a dump (see 'modb help dump') from stdin into a local datastore, keeping")
+	fmt.Println("the original op ids. Ops already in the datastore are skipped, so loading the")
+	fmt.Println("same dump twice is harmless. The datastore shouldn't be in use by a server.")
+	fmt.Println("")
+	fmt.Println("Usage:")
+	fmt.Println("")
+	fmt.Println("  modb load [flags] [fileOrDirName] < dump.jsonl")
+	fmt.Println("")
+	fmt.Println("Flags:")
+	fmt.Println("")
+	fmt.Println("  -h, --help")
+	fmt.Println("        help for load")
+	fmt.Println("")
+	fmt.Println("  -d, --datastore")
+	fmt.Println("        type of datastore: bbolt, badger, level (default: bbolt)")
+	fmt.Println("")
+	fmt.Println("Use 'modb help [command]' for more information about a command.")
+	return nil
+}
+
+func CmdLoad(opts Opts) error {
+	if opts.Help == true {
+		return CmdHelpLoad("")
+	}
+
+	if opts.Pathname == "" {
+		return CmdHelpLoad("Provide a path for your datastore")
+	}
+
+	log.Println("MoDB Started")
+	defer log.Println("MoDB Finished")
+
+	// Datastore
+	db, err := NewStore(opts.Datastore, opts.Pathname)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		log.Println("Closing Datastore")
+		db.Close()
+	}()
+
+	log.Println("Loading datastore ...")
+	stats, err := load(db, os.Stdin)
+	if err != nil {
+		return err
+	}
+	log.Printf("Loaded %d ops and %d data entries, skipping %d ops already present\n", stats.written, stats.data, stats.ops-stats.written)
+
+	return nil
+}
+
+// dumpLine is one line of a dump, being either a log entry or a data entry.
+type dumpLine struct {
+	Key  string          `json:"key"`
+	Id   string          `json:"id"`
+	Op   string          `json:"op"`
+	Diff json.RawMessage `json:"diff"`
+	Data json.RawMessage `json:"data"`
+}
+
+// readDump calls fn with each entry in a dump, where data entries have no op.
+// Anything which couldn't have come from a dump is an error, naming the line.
+func readDump(r io.Reader, fn func(entry dumpLine) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLine)
+	n := 0
+	for scanner.Scan() {
+		n++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var entry dumpLine
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", n, err)
+		}
+		if entry.Key == "" {
+			return fmt.Errorf("line %d: missing key", n)
+		}
+		if entry.Op == "" {
+			if entry.Data == nil {
+				return fmt.Errorf("line %d: missing op or data", n)
+			}
+		} else {
+			if _, err := store.IdTime(entry.Id); err != nil {
+				return fmt.Errorf("line %d: %s", n, err)
+			}
+			if !store.ValidOp(entry.Op) {
+				return fmt.Errorf("line %d: unknown op '%s'", n, entry.Op)
+			}
+			if entry.Diff == nil {
+				return fmt.Errorf("line %d: missing diff", n)
+			}
+		}
+
+		err = fn(entry)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// loadStats counts what load did.
+type loadStats struct {
+	ops     int // ops read
+	written int // ops written, the rest being already present
+	data    int // data entries written
+	skipped int // log entries which couldn't be parsed
+	defs    int // schema, index and view definitions written
+}
+
+// load writes every entry in the dump to the datastore.
+func load(db store.Storage, r io.Reader) (loadStats, error) {
+	var stats loadStats
+	var batch []store.Change
+	flush := func() error {
+		n, err := db.Append(batch)
+		stats.written += n
+		batch = batch[:0]
+		return err
+	}
+	var data []store.Data
+	flushData := func() error {
+		err := db.PutDataBatch(data)
+		data = data[:0]
+		return err
+	}
+
+	err := readDump(r, func(entry dumpLine) error {
+		if entry.Op == "" {
+			stats.data++
+			data = append(data, store.Data{Key: entry.Key, Val: string(entry.Data)})
+			if len(data) < loadBatch {
+				return nil
+			}
+			return flushData()
+		}
+
+		stats.ops++
+		batch = append(batch, store.Change{Key: entry.Key, Id: entry.Id, Op: entry.Op, Diff: string(entry.Diff)})
+		if len(batch) < loadBatch {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	err = flush()
+	if err != nil {
+		return stats, err
+	}
+	return stats, flushData()
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/modb-dev/modb/store"
+)
+
+func CmdHelpMigrate(msg string) error {
+	if msg != "" {
+		fmt.Printf("Error: %s\n\n", msg)
+	}
+	fmt.Println("Copy the whole log and data of one local datastore into another, which may be")
+	fmt.Println("of a different type, keeping the original op ids, along with its schemas,")
+	fmt.Println("indexes and views. Log entries which can't be parsed are skipped, as with")
+	fmt.Println("dump. Every key's signature is then compared between the two and any")
+	fmt.Println("mismatches reported. Neither datastore should be in use by a server.")
+	fmt.Println("")
+	fmt.Println("Usage:")
+	fmt.Println("")
+	fmt.Println("  modb migrate --from <type>:<path> --to <type>:<path>")
+	fmt.Println("")
+	fmt.Println("Flags:")
+	fmt.Println("")
+	fmt.Println("  -h, --help")
+	fmt.Println("        help for migrate")
+	fmt.Println("")
+	fmt.Println("  --from")
+	fmt.Println("        datastore to copy from, e.g. bbolt:data/bbolt.db")
+	fmt.Println("")
+	fmt.Println("  --to")
+	fmt.Println("        datastore to copy to, e.g. badger:data/badger")
+	fmt.Println("")
+	fmt.Println("Use 'modb help [command]' for more information about a command.")
+	return nil
+}
+
+func CmdMigrate(opts Opts) error {
+	if opts.Help == true {
+		return CmdHelpMigrate("")
+	}
+
+	fromType, fromPath, ok := splitStore(opts.From)
+	if !ok {
+		return CmdHelpMigrate("Provide --from as <type>:<path>")
+	}
+	toType, toPath, ok := splitStore(opts.To)
+	if !ok {
+		return CmdHelpMigrate("Provide --to as <type>:<path>")
+	}
+
+	log.Println("MoDB Started")
+	defer log.Println("MoDB Finished")
+
+	// Datastores
+	from, err := NewStore(fromType, fromPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		log.Println("Closing Datastore " + opts.From)
+		from.Close()
+	}()
+
+	to, err := NewStore(toType, toPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		log.Println("Closing Datastore " + opts.To)
+		to.Close()
+	}()
+
+	log.Println("Copying datastore ...")
+	stats, err := copyStore(from, to)
+	if err != nil {
+		return err
+	}
+	log.Printf("Copied %d ops, %d data entries and %d definitions, skipping %d ops already present\n", stats.written, stats.data, stats.defs, stats.ops-stats.written)
+	if stats.skipped > 0 {
+		log.Printf("Skipped %d log entries which couldn't be parsed, see 'modb verify'\n", stats.skipped)
+	}
+
+	log.Println("Verifying signatures ...")
+	checked, mismatched, err := compareSignatures(from, to, func(key string, a, b string) {
+		log.Printf("Mismatch %s: %s != %s", key, a, b)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Checked %d keys\n", checked)
+	if mismatched > 0 {
+		return fmt.Errorf("%d keys have mismatched signatures", mismatched)
+	}
+
+	return nil
+}
+
+// splitStore splits "<type>:<path>" in two.
+func splitStore(arg string) (string, string, bool) {
+	parts := strings.SplitN(arg, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// copyStore copies every log and data entry from one datastore to another,
+// then the definitions which live alongside them. Log entries which can't be
+// parsed are skipped with a warning.
+func copyStore(from, to store.Storage) (loadStats, error) {
+	var stats loadStats
+	var batch []store.Change
+	flush := func() error {
+		n, err := to.Append(batch)
+		stats.written += n
+		batch = batch[:0]
+		return err
+	}
+
+	var copyErr error
+	err := from.IterateLog("", func(k, v string) bool {
+		change, err := store.ParseLogEntry(k, v)
+		if err != nil {
+			log.Printf("Skipping %s", err)
+			stats.skipped++
+			return true
+		}
+		stats.ops++
+		batch = append(batch, change)
+		if len(batch) == loadBatch {
+			copyErr = flush()
+		}
+		return copyErr == nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	if copyErr != nil {
+		return stats, copyErr
+	}
+	err = flush()
+	if err != nil {
+		return stats, err
+	}
+
+	var data []store.Data
+	err = from.IterateData("", func(k, v string) bool {
+		stats.data++
+		data = append(data, store.Data{Key: k, Val: v})
+		if len(data) == loadBatch {
+			copyErr = to.PutDataBatch(data)
+			data = data[:0]
+		}
+		return copyErr == nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	if copyErr != nil {
+		return stats, copyErr
+	}
+	err = to.PutDataBatch(data)
+	if err != nil {
+		return stats, err
+	}
+
+	stats.defs, err = copyDefs(from, to)
+	return stats, err
+}
+
+// copyDefs copies the schemas, indexes and views from one datastore to another,
+// along with each index's entries since they are only built when the index is
+// created. Views are only held in memory, so they're built afresh by the
+// server. It returns how many definitions were copied.
+func copyDefs(from, to store.Storage) (int, error) {
+	var schemas, indexes, views [][2]string
+	err := from.IterateSchemas(func(prefix, schema string) {
+		schemas = append(schemas, [2]string{prefix, schema})
+	})
+	if err == nil {
+		err = from.IterateIndexes(func(name, def string) {
+			indexes = append(indexes, [2]string{name, def})
+		})
+	}
+	if err == nil {
+		err = from.IterateViews(func(name, def string) {
+			views = append(views, [2]string{name, def})
+		})
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for _, schema := range schemas {
+		err := to.PutSchema(schema[0], schema[1])
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, index := range indexes {
+		err := to.PutIndex(index[0], index[1])
+		if err != nil {
+			return 0, err
+		}
+		var entries [][2]string
+		err = from.IterateIndex(index[0], "", "", func(value, key string) bool {
+			entries = append(entries, [2]string{key, value})
+			return true
+		})
+		if err != nil {
+			return 0, err
+		}
+		for _, entry := range entries {
+			err := to.SetIndexEntry(index[0], entry[0], entry[1])
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	for _, view := range views {
+		err := to.PutView(view[0], view[1])
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(schemas) + len(indexes) + len(views), nil
+}
+
+// compareSignatures compares the signature of every key in either datastore,
+// calling fn with each mismatch (where a missing key has an empty signature),
+// and returns how many keys were checked and how many mismatched.
+func compareSignatures(a, b store.Storage, fn func(key, sigA, sigB string)) (int, int, error) {
+	keys, err := allKeys(a)
+	if err != nil {
+		return 0, 0, err
+	}
+	keysB, err := allKeys(b)
+	if err != nil {
+		return 0, 0, err
+	}
+	keys = mergeKeys(keys, keysB)
+
+	mismatched := 0
+	for _, key := range keys {
+		sigA, err := signature(a, key)
+		if err != nil {
+			return 0, 0, err
+		}
+		sigB, err := signature(b, key)
+		if err != nil {
+			return 0, 0, err
+		}
+		if sigA != sigB {
+			mismatched++
+			fn(key, sigA, sigB)
+		}
+	}
+	return len(keys), mismatched, nil
+}
+
+// signature returns the key's signature as "<count>:<sha256>", or an empty
+// string if it has no changes.
+func signature(db store.Storage, key string) (string, error) {
+	count, sum, err := store.Signature(db, key)
+	if err != nil || count == 0 {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%s", count, sum), nil
+}
+
+// allKeys returns every key in the log, in key order and without duplicates,
+// which the log's own order doesn't give (see store.IterateKeyRange).
+func allKeys(db store.Storage) ([]string, error) {
+	var keys []string
+	err := db.IterateRange("", "", false, func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys, err
+}
+
+// mergeKeys merges two ordered lists of keys, without duplicates.
+func mergeKeys(a, b []string) []string {
+	var keys []string
+	for len(a) > 0 || len(b) > 0 {
+		switch {
+		case len(b) == 0 || (len(a) > 0 && a[0] < b[0]):
+			keys = append(keys, a[0])
+			a = a[1:]
+		case len(a) == 0 || b[0] < a[0]:
+			keys = append(keys, b[0])
+			b = b[1:]
+		default:
+			keys = append(keys, a[0])
+			a, b = a[1:], b[1:]
+		}
+	}
+	return keys
+}
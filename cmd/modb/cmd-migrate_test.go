@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/modb-dev/modb/store"
+	"github.com/modb-dev/modb/store/bbolt"
+	"github.com/modb-dev/modb/store/level"
+)
+
+func TestCompareSignatures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, err := bbolt.Open(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := level.Open(filepath.Join(dir, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// the log is ordered by key:id, so user:1-x comes before user:1, and the
+	// entries of a key named after one of user:1's ids fall amongst its own
+	at := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	id1, id2, id3 := store.IdAt(at), store.IdAt(at.Add(time.Second)), store.IdAt(at.Add(2*time.Second))
+	both := []store.Change{
+		{Key: "user:1", Id: id1, Op: "put", Diff: `{"n":1}`},
+		{Key: "user:1", Id: id3, Op: "inc", Diff: `{"n":true}`},
+		{Key: "user:1:" + id2, Id: id2, Op: "put", Diff: `{"n":1}`},
+		{Key: "user:10", Id: id1, Op: "put", Diff: `{"n":1}`},
+	}
+	onlyA := []store.Change{
+		{Key: "user:1-x", Id: id1, Op: "put", Diff: `{"n":1}`},
+		{Key: "user:10", Id: id2, Op: "inc", Diff: `{"n":true}`},
+	}
+	if _, err := a.Append(append(both, onlyA...)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Append(both); err != nil {
+		t.Fatal(err)
+	}
+
+	var mismatches []string
+	checked, mismatched, err := compareSignatures(a, b, func(key, sigA, sigB string) {
+		mismatches = append(mismatches, key)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 4 {
+		t.Errorf("checked %d keys, want 4", checked)
+	}
+	if want := []string{"user:1-x", "user:10"}; !reflect.DeepEqual(mismatches, want) || mismatched != 2 {
+		t.Errorf("%d keys mismatched %v, want %v", mismatched, mismatches, want)
+	}
+}
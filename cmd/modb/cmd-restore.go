@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+func CmdHelpRestore(msg string) error {
+	if msg != "" {
+		fmt.Printf("Error: %s\n\n", msg)
+	}
+	fmt.Println("Create a new local datastore from a backup made with the server's `backup`")
+	fmt.Println("command, then apply any incremental backups on top, in the order given.")
+	fmt.Println("")
+	fmt.Println("A full backup is in the datastore's own format (bbolt's Tx.WriteTo, badger's")
+	fmt.Println("Backup, or a leveldb snapshot) and holds everything, including schemas,")
+	fmt.Println("indexes and views, so restore it with the same --datastore type the server")
+	fmt.Println("uses, then 'modb migrate' to change type. Views are rebuilt by the server.")
+	fmt.Println("")
+	fmt.Println("An incremental backup holds only the ops with ids after the one it was made")
+	fmt.Println("since, in the same format as `modb dump`. Indexes are kept up to date as its")
+	fmt.Println("ops are restored, but data entries, schemas, and index and view definitions")
+	fmt.Println("changed since the full backup are left out, as is an op loaded from another")
+	fmt.Println("node with an older id after a backup. Take a full backup after either.")
+	fmt.Println("")
+	fmt.Println("Usage:")
+	fmt.Println("")
+	fmt.Println("  modb restore [flags] [fileOrDirName] [backup] [incremental...]")
+	fmt.Println("")
+	fmt.Println("Flags:")
+	fmt.Println("")
+	fmt.Println("  -h, --help")
+	fmt.Println("        help for restore")
+	fmt.Println("")
+	fmt.Println("  -d, --datastore")
+	fmt.Println("        type of datastore: bbolt, badger, level (default: bbolt)")
+	fmt.Println("")
+	fmt.Println("Use 'modb help [command]' for more information about a command.")
+	return nil
+}
+
+func CmdRestore(opts Opts) error {
+	if opts.Help == true {
+		return CmdHelpRestore("")
+	}
+
+	if opts.Pathname == "" {
+		return CmdHelpRestore("Provide a path for your datastore")
+	}
+
+	if len(opts.Args) == 0 {
+		return CmdHelpRestore("Provide a backup to restore")
+	}
+
+	if _, err := os.Stat(opts.Pathname); err == nil {
+		return CmdHelpRestore("The datastore already exists, restore to a new path")
+	}
+
+	log.Println("MoDB Started")
+	defer log.Println("MoDB Finished")
+
+	return restore(opts.Datastore, opts.Pathname, opts.Args)
+}
+
+// restore creates a new datastore at pathname from a full backup, then loads
+// each incremental backup on top, in order.
+func restore(datastore, pathname string, backups []string) error {
+	log.Printf("Restoring %s ...\n", backups[0])
+	f, err := os.Open(backups[0])
+	if err != nil {
+		return err
+	}
+	err = RestoreStore(datastore, pathname, f)
+	f.Close()
+	if err != nil {
+		os.RemoveAll(pathname)
+		return fmt.Errorf("%s: %s", backups[0], err)
+	}
+
+	// Datastore
+	db, err := NewStore(datastore, pathname)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		log.Println("Closing Datastore")
+		db.Close()
+	}()
+
+	// the indexes follow the ops being loaded, as they would on the server
+	indexer, err := NewIndexer(db)
+	if err != nil {
+		return err
+	}
+	defer indexer.Close()
+
+	for _, filename := range backups[1:] {
+		log.Printf("Restoring %s ...\n", filename)
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		stats, err := load(db, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", filename, err)
+		}
+		log.Printf("Restored %d ops and %d data entries, skipping %d ops already present\n", stats.written, stats.data, stats.ops-stats.written)
+	}
+
+	return nil
+}
@@ -29,6 +29,9 @@ func CmdHelpServer(msg string) error {
 	fmt.Println("  -d, --datastore")
 	fmt.Println("        path to datastore")
 	fmt.Println("")
+	fmt.Println("  --backup-dir")
+	fmt.Println("        directory the backup command writes to, which is off if not given")
+	fmt.Println("")
 	fmt.Println("Use 'modb help [command]' for more information about a command.")
 	return nil
 }
@@ -43,7 +46,7 @@ func CmdServer(opts Opts) error {
 	}
 
 	log.Println("MoDB Started")
-	defer log.Println("MoDB Finished\n")
+	defer log.Println("MoDB Finished")
 
 	// create a context that can be cancelled
 	_, cancel := context.WithCancel(context.Background())
@@ -77,6 +80,39 @@ func CmdServer(opts Opts) error {
 		db.Close()
 	}()
 
+	// rejects ops which break the rules for their key
+	guard, err := NewGuard(db)
+	if err != nil {
+		return err
+	}
+
+	// keeps the secondary indexes up to date
+	indexer, err := NewIndexer(db)
+	if err != nil {
+		return err
+	}
+	defer indexer.Close()
+
+	// keeps the materialized views up to date
+	views, err := NewViews(db)
+	if err != nil {
+		return err
+	}
+	defer views.Close()
+
+	// Compactor
+	{
+		compactor := NewCompactor(db)
+
+		group.Add(func() error {
+			log.Println("Starting Compactor")
+			return compactor.Run()
+		}, func(error) {
+			log.Println("Stopping Compactor")
+			compactor.Stop()
+		})
+	}
+
 	// Client Server
 	var server *redcon.Server
 	{
@@ -84,7 +120,7 @@ func CmdServer(opts Opts) error {
 
 		group.Add(func() error {
 			log.Println("Creating Client Server")
-			server = NewClientServer(addr, db)
+			server = NewClientServer(addr, guard, indexer, views, opts.BackupDir)
 			log.Printf("Client Server about to listen on %s\n", addr)
 			return server.ListenAndServe()
 		}, func(error) {
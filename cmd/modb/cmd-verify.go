@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/modb-dev/modb/store"
+	"github.com/valyala/fastjson"
+)
+
+func CmdHelpVerify(msg string) error {
+	if msg != "" {
+		fmt.Printf("Error: %s\n\n", msg)
+	}
+	fmt.Println("Check every log and data entry in a local datastore, reporting any which are")
+	fmt.Println("malformed: log keys without an op id, ids which aren't valid, log values")
+	fmt.Println("without an op, unknown ops, diffs which aren't valid JSON or can't be applied,")
+	fmt.Println("and data entries which don't match a replay of the log. With --repair, each bad")
+	fmt.Println("entry is moved to the datastore's quarantine. The datastore shouldn't be in use")
+	fmt.Println("by a server.")
+	fmt.Println("")
+	fmt.Println("Usage:")
+	fmt.Println("")
+	fmt.Println("  modb verify [flags] [fileOrDirName]")
+	fmt.Println("")
+	fmt.Println("Flags:")
+	fmt.Println("")
+	fmt.Println("  -h, --help")
+	fmt.Println("        help for verify")
+	fmt.Println("")
+	fmt.Println("  -d, --datastore")
+	fmt.Println("        type of datastore: bbolt, badger, level (default: bbolt)")
+	fmt.Println("")
+	fmt.Println("  --repair")
+	fmt.Println("        quarantine each bad entry found")
+	fmt.Println("")
+	fmt.Println("Use 'modb help [command]' for more information about a command.")
+	return nil
+}
+
+func CmdVerify(opts Opts) error {
+	if opts.Help == true {
+		return CmdHelpVerify("")
+	}
+
+	if opts.Pathname == "" {
+		return CmdHelpVerify("Provide a path for your datastore")
+	}
+
+	log.Println("MoDB Started")
+	defer log.Println("MoDB Finished")
+
+	// Datastore
+	db, err := NewStore(opts.Datastore, opts.Pathname)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		log.Println("Closing Datastore")
+		db.Close()
+	}()
+
+	log.Println("Verifying datastore ...")
+	stats, problems, err := verify(db)
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	log.Printf("Checked %d log entries and %d data entries, finding %d problems\n", stats.ops, stats.data, len(problems))
+	if len(problems) == 0 {
+		return nil
+	}
+
+	if !opts.Repair {
+		return fmt.Errorf("%d problems found, use --repair to quarantine them", len(problems))
+	}
+	for _, p := range problems {
+		err := db.Quarantine(p.log, p.key)
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Quarantined %d entries\n", len(problems))
+
+	return nil
+}
+
+// problem is a bad log or data entry, named by its raw key.
+type problem struct {
+	log    bool
+	key    string
+	reason string
+}
+
+func (p problem) String() string {
+	if p.log {
+		return fmt.Sprintf("log  %q: %s", p.key, p.reason)
+	}
+	return fmt.Sprintf("data %q: %s", p.key, p.reason)
+}
+
+// verify checks every entry in the datastore, returning how many there were and
+// the problems found, in the order of the log then the data. The good changes
+// of every key are held in memory so that each key can be replayed.
+func verify(db store.Storage) (loadStats, []problem, error) {
+	var stats loadStats
+	var problems []problem
+
+	changes := map[string][]store.Change{}
+	err := db.IterateLog("", func(k, v string) bool {
+		stats.ops++
+		key, id := store.SplitLogKey(k)
+		if id == "" {
+			problems = append(problems, problem{true, k, "missing ':' between key and op id"})
+			return true
+		}
+		if _, err := store.IdTime(id); err != nil {
+			problems = append(problems, problem{true, k, err.Error()})
+			return true
+		}
+		opDiff := strings.SplitN(v, store.Separator, 2)
+		if len(opDiff) != 2 {
+			problems = append(problems, problem{true, k, "missing ':' between op and diff"})
+			return true
+		}
+		if !store.ValidOp(opDiff[0]) {
+			problems = append(problems, problem{true, k, "unknown op '" + opDiff[0] + "'"})
+			return true
+		}
+		if err := fastjson.Validate(opDiff[1]); err != nil {
+			problems = append(problems, problem{true, k, "invalid diff: " + err.Error()})
+			return true
+		}
+		changes[key] = append(changes[key], store.Change{Key: key, Id: id, Op: opDiff[0], Diff: opDiff[1]})
+		return true
+	})
+	if err != nil {
+		return stats, nil, err
+	}
+
+	// replay each key a change at a time, so any which can't be applied are
+	// found and left out
+	keys := make([]string, 0, len(changes))
+	for key := range changes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	docs := map[string]*store.Doc{}
+	for _, key := range keys {
+		sort.Slice(changes[key], func(i, j int) bool { return changes[key][i].Id < changes[key][j].Id })
+		doc := store.NewDoc()
+		var good []store.Change
+		for _, change := range changes[key] {
+			if err := doc.Apply(change); err != nil {
+				problems = append(problems, problem{true, key + store.Separator + change.Id, err.Error()})
+				// start again, since the failed change may have been half applied
+				doc, _ = store.Replay(good)
+				continue
+			}
+			good = append(good, change)
+		}
+		docs[key] = doc
+	}
+
+	err = db.IterateData("", func(k, v string) bool {
+		stats.data++
+		doc := docs[k]
+		if doc == nil {
+			problems = append(problems, problem{false, k, "no log for this key"})
+		} else if doc.Deleted() {
+			problems = append(problems, problem{false, k, "key has been deleted"})
+		} else if !sameJSON(v, doc.String()) {
+			problems = append(problems, problem{false, k, "doesn't match the log, which gives " + doc.String()})
+		}
+		return true
+	})
+	if err != nil {
+		return stats, nil, err
+	}
+
+	return stats, problems, nil
+}
+
+// sameJSON reports whether a and b are both JSON for the same value, whatever
+// the order of their fields.
+func sameJSON(a, b string) bool {
+	var x, y interface{}
+	if json.Unmarshal([]byte(a), &x) != nil || json.Unmarshal([]byte(b), &y) != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/modb-dev/modb/store"
+)
+
+// compactInterval is how often the log is swept for expired keys.
+const compactInterval = time.Minute
+
+// Compactor sweeps the log every so often, purging each key which has expired
+// so that it stops taking up space.
+type Compactor struct {
+	db   store.Storage
+	done chan struct{}
+}
+
+func NewCompactor(db store.Storage) *Compactor {
+	return &Compactor{
+		db:   db,
+		done: make(chan struct{}),
+	}
+}
+
+// Run compacts the log every compactInterval until Stop is called.
+func (c *Compactor) Run() error {
+	ticker := time.NewTicker(compactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n, err := c.Compact()
+			if err != nil {
+				log.Printf("compactor.Compact() - err: %s", err)
+			}
+			if n > 0 {
+				log.Printf("Compacted %d expired keys", n)
+			}
+		case <-c.done:
+			return nil
+		}
+	}
+}
+
+// Stop ends Run.
+func (c *Compactor) Stop() {
+	close(c.done)
+}
+
+// Compact purges every key which has expired, returning how many were. Only
+// the changes which were read are purged, so an op written in the meantime
+// survives and starts the key afresh. A key whose changes can't be replayed is
+// skipped, so that it doesn't hold up the rest.
+func (c *Compactor) Compact() (int, error) {
+	purged := 0
+	var compactErr error
+	err := c.db.IterateRange("", "", false, func(key string) bool {
+		var changes []store.Change
+		compactErr = c.db.IterateChanges(key, func(change store.Change) {
+			changes = append(changes, change)
+		})
+		if compactErr != nil || len(changes) == 0 {
+			return compactErr == nil
+		}
+
+		doc, err := store.Replay(changes)
+		if err != nil {
+			log.Printf("Skipping key '%s' which can't be replayed: %s", key, err)
+			return true
+		}
+		if !doc.Expired() {
+			return true
+		}
+
+		compactErr = c.db.Purge(key, changes[len(changes)-1].Id)
+		if compactErr == nil {
+			purged++
+		}
+		return compactErr == nil
+	})
+	if err != nil {
+		return purged, err
+	}
+	return purged, compactErr
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/modb-dev/modb/store"
+)
+
+func TestCompact(t *testing.T) {
+	db := testStore(t)
+
+	// keys which share a prefix, so the log's key:id order isn't key order
+	expired := []string{"user", "user:1", "user:a"}
+	for _, key := range expired {
+		if err := db.Put(key, `{"n":1}`); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Inc(key, `{"n":true}`); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Expire(key, `{"deadline":"2000-01-01T00:00:00Z"}`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("user:2", `{"n":1}`); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.Append([]store.Change{{Key: "user:0", Id: store.IdAt(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)), Op: "put", Diff: `{bad`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := NewCompactor(db).Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(expired) {
+		t.Errorf("compacted %d keys, want %d", n, len(expired))
+	}
+	for _, key := range append(expired, "user:2", "user:0") {
+		count := 0
+		err := db.IterateChanges(key, func(change store.Change) { count++ })
+		if err != nil {
+			t.Fatal(err)
+		}
+		purged := count == 0
+		if want := key != "user:2" && key != "user:0"; purged != want {
+			t.Errorf("%s purged = %v, want %v", key, purged, want)
+		}
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	for _, arg := range []string{"NaN", "Inf", "-Inf", "+Inf", "-1", "0", "x"} {
+		if _, err := deadline(arg); err == nil {
+			t.Errorf("deadline(%q) gave no error", arg)
+		}
+	}
+	if _, err := deadline("0.5"); err != nil {
+		t.Errorf("deadline(\"0.5\") = %s", err)
+	}
+}
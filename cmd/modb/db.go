@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"io"
 	"log"
 
 	"github.com/modb-dev/modb/store"
@@ -29,3 +30,21 @@ func NewStore(datastore, pathname string) (store.Storage, error) {
 
 	return nil, errors.New("Unknown datastore")
 }
+
+// RestoreStore creates a new datastore at pathname from a full backup, which
+// must have been made from a datastore of the same type.
+func RestoreStore(datastore, pathname string, r io.Reader) error {
+	if datastore == "bbolt" {
+		return bbolt.Restore(pathname, r)
+	}
+
+	if datastore == "badger" {
+		return badger.Restore(pathname, r)
+	}
+
+	if datastore == "level" {
+		return level.Restore(pathname, r)
+	}
+
+	return errors.New("Unknown datastore")
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/modb-dev/modb/store"
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+// feedBuffer is how many changes a subscriber may fall behind by before it is
+// disconnected. It can reconnect using `since` to carry on where it left off.
+const feedBuffer = 1024
+
+// feed follows the changes to some keys (or key patterns) for a subscriber.
+type feed struct {
+	db       store.Storage
+	dc       redcon.DetachedConn
+	mu       sync.Mutex // serialises writes to dc
+	patterns bool
+	subjects []string
+	since    string
+}
+
+func Subscribe(db store.Storage, conn redcon.Conn, patterns bool, args ...[]byte) {
+	// Usage:
+	// > subscribe users:1 users:2 [SINCE <op-id>]
+	// > psubscribe users:* [SINCE <op-id>]
+	//
+	// Each change is pushed as ["message", key, json] (or ["pmessage", pattern,
+	// key, json]) where the json is {"key", "id", "op", "diff"}. With SINCE,
+	// every change after that op id is sent first so a subscriber can resume.
+
+	name := "subscribe"
+	if patterns {
+		name = "psubscribe"
+	}
+
+	f := &feed{db: db, patterns: patterns}
+	for i := 0; i < len(args); i++ {
+		if strings.ToLower(string(args[i])) == "since" && i == len(args)-2 {
+			f.since = string(args[i+1])
+			break
+		}
+		f.subjects = append(f.subjects, string(args[i]))
+	}
+	if len(f.subjects) == 0 {
+		conn.WriteError("ERR wrong number of arguments: " + name + " <key...> [SINCE <op-id>]")
+		return
+	}
+
+	// start listening before reading any past changes, so none fall in between
+	changes := make(chan store.Change, feedBuffer)
+	overflow := make(chan struct{})
+	var once sync.Once
+	stop := db.Listen(func(change store.Change) {
+		// a purge only tidies away what had already expired, and isn't in the
+		// log for a subscriber to resume from
+		if change.Op == "purge" || f.match(change.Key) == "" {
+			return
+		}
+		select {
+		case changes <- change:
+		default:
+			once.Do(func() { close(overflow) })
+		}
+	})
+
+	f.dc = conn.Detach()
+	go func() {
+		defer stop()
+		defer f.dc.Close()
+		f.run(name, changes, overflow)
+	}()
+}
+
+func (f *feed) run(name string, changes chan store.Change, overflow chan struct{}) {
+	f.mu.Lock()
+	for i, subject := range f.subjects {
+		f.dc.WriteArray(3)
+		f.dc.WriteBulkString(name)
+		f.dc.WriteBulkString(subject)
+		f.dc.WriteInt(i + 1)
+	}
+	f.mu.Unlock()
+
+	sent := map[string]bool{}
+	if f.since != "" {
+		backlog, err := f.backlog()
+		if err != nil {
+			log.Printf("feed.backlog() - err: %s", err)
+			return
+		}
+		for _, change := range backlog {
+			f.write(change)
+			sent[change.Id] = true
+		}
+	}
+	err := f.flush()
+	if err != nil {
+		return
+	}
+
+	// the subscriber may only ping, or unsubscribe which ends the feed
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			cmd, err := f.dc.ReadCommand()
+			if err != nil {
+				return
+			}
+			switch strings.ToLower(string(cmd.Args[0])) {
+			case "ping":
+				f.mu.Lock()
+				f.dc.WriteArray(2)
+				f.dc.WriteBulkString("pong")
+				f.dc.WriteBulkString("")
+				f.mu.Unlock()
+				if f.flush() != nil {
+					return
+				}
+			case "unsubscribe", "punsubscribe", "quit":
+				f.mu.Lock()
+				f.dc.WriteString("OK")
+				f.mu.Unlock()
+				f.flush()
+				return
+			default:
+				f.mu.Lock()
+				f.dc.WriteError("ERR only ping and unsubscribe are allowed whilst subscribed")
+				f.mu.Unlock()
+				if f.flush() != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		select {
+		case change := <-changes:
+			if sent[change.Id] {
+				continue
+			}
+			f.write(change)
+			if f.flush() != nil {
+				return
+			}
+		case <-overflow:
+			log.Printf("Subscriber %s fell behind, disconnecting", f.dc.RemoteAddr())
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// backlog reads every matching change after `since` from the log, in order.
+func (f *feed) backlog() ([]store.Change, error) {
+	keys := f.subjects
+	if f.patterns {
+		keys = nil
+		err := f.db.IterateRange("", "", false, func(key string) bool {
+			if f.match(key) != "" {
+				keys = append(keys, key)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var backlog []store.Change
+	for _, key := range keys {
+		err := f.db.IterateChanges(key, func(change store.Change) {
+			if change.Id > f.since {
+				backlog = append(backlog, change)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(backlog, func(i, j int) bool { return backlog[i].Id < backlog[j].Id })
+	return backlog, nil
+}
+
+// match returns the subject which matches key, or an empty string.
+func (f *feed) match(key string) string {
+	for _, subject := range f.subjects {
+		if (f.patterns && match.Match(key, subject)) || (!f.patterns && key == subject) {
+			return subject
+		}
+	}
+	return ""
+}
+
+func (f *feed) write(change store.Change) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.patterns {
+		f.dc.WriteArray(4)
+		f.dc.WriteBulkString("pmessage")
+		f.dc.WriteBulkString(f.match(change.Key))
+	} else {
+		f.dc.WriteArray(3)
+		f.dc.WriteBulkString("message")
+	}
+	f.dc.WriteBulkString(change.Key)
+	f.dc.WriteBulkString(change.JSON())
+}
+
+func (f *feed) flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dc.Flush()
+}
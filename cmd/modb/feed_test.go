@@ -0,0 +1,36 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/modb-dev/modb/store"
+)
+
+func TestFeedBacklog(t *testing.T) {
+	db := testStore(t)
+	// the log holds "user:0a", "user:1:1a", "user:2a", so user's entries sit
+	// either side of user:1's
+	_, err := db.Append([]store.Change{
+		{Key: "user", Id: "0a", Op: "put", Diff: `{"n":1}`},
+		{Key: "user:1", Id: "1a", Op: "put", Diff: `{"n":2}`},
+		{Key: "user", Id: "2a", Op: "inc", Diff: `{"n":true}`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &feed{db: db, patterns: true, subjects: []string{"user*"}, since: "0"}
+	backlog, err := f.backlog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, change := range backlog {
+		got = append(got, change.Key+":"+change.Id)
+	}
+	want := []string{"user:0a", "user:1:1a", "user:2a"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("backlog = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/chilts/sid"
+	"github.com/modb-dev/modb/schema"
+	"github.com/modb-dev/modb/store"
+)
+
+// RejectedError is returned when an op is refused before it is written.
+type RejectedError struct {
+	msg string
+}
+
+func (e *RejectedError) Error() string {
+	return e.msg
+}
+
+// Guard wraps a datastore and rejects any op which breaks the type rules for
+// ops (see store.Doc.Check) or which would leave a document breaking the JSON
+// Schema registered against its key's prefix. Deletes are never checked against
+// a schema since a deleted document has nothing left to validate.
+type Guard struct {
+	store.Storage
+	mu      sync.RWMutex
+	schemas map[string]*schema.Schema
+	keys    keyLocks
+}
+
+func NewGuard(db store.Storage) (*Guard, error) {
+	g := &Guard{
+		Storage: db,
+		schemas: map[string]*schema.Schema{},
+	}
+
+	var err error
+	iterErr := db.IterateSchemas(func(prefix, src string) {
+		s, compileErr := schema.Compile(src)
+		if compileErr != nil && err == nil {
+			err = compileErr
+		}
+		g.schemas[prefix] = s
+	})
+	if iterErr != nil {
+		return nil, iterErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// PutSchema compiles and stores the JSON Schema for keys starting with prefix.
+func (g *Guard) PutSchema(prefix, src string) error {
+	s, err := schema.Compile(src)
+	if err != nil {
+		return &RejectedError{"invalid schema: " + err.Error()}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	err = g.Storage.PutSchema(prefix, src)
+	if err != nil {
+		return err
+	}
+	g.schemas[prefix] = s
+	return nil
+}
+
+// DelSchema removes the JSON Schema for prefix.
+func (g *Guard) DelSchema(prefix string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	err := g.Storage.DelSchema(prefix)
+	if err != nil {
+		return err
+	}
+	delete(g.schemas, prefix)
+	return nil
+}
+
+func (g *Guard) Put(key, json string) error {
+	return g.write(key, "put", json, g.Storage.Put)
+}
+
+func (g *Guard) Del(key, json string) error {
+	return g.write(key, "del", json, g.Storage.Del)
+}
+
+func (g *Guard) Inc(key, json string) error {
+	return g.write(key, "inc", json, g.Storage.Inc)
+}
+
+func (g *Guard) IncBy(key, json string) error {
+	return g.write(key, "incby", json, g.Storage.IncBy)
+}
+
+func (g *Guard) Max(key, json string) error {
+	return g.write(key, "max", json, g.Storage.Max)
+}
+
+func (g *Guard) Min(key, json string) error {
+	return g.write(key, "min", json, g.Storage.Min)
+}
+
+func (g *Guard) MvSet(key, json string) error {
+	return g.write(key, "mvset", json, g.Storage.MvSet)
+}
+
+func (g *Guard) Resolve(key, json string) error {
+	return g.write(key, "resolve", json, g.Storage.Resolve)
+}
+
+func (g *Guard) TextIns(key, json string) error {
+	return g.write(key, "textins", json, g.Storage.TextIns)
+}
+
+func (g *Guard) TextDel(key, json string) error {
+	return g.write(key, "textdel", json, g.Storage.TextDel)
+}
+
+func (g *Guard) Expire(key, json string) error {
+	return g.write(key, "expire", json, g.Storage.Expire)
+}
+
+// PutExpire is a Put followed by an Expire, written together so that the
+// document is never left without its deadline.
+func (g *Guard) PutExpire(key, json, deadline string) error {
+	unlock := g.keys.lock(key)
+	defer unlock()
+
+	err := g.check(key, "put", json)
+	if err != nil {
+		return err
+	}
+
+	// the expire has to come after the put, since a put clears any deadline
+	put := store.Change{Key: key, Id: sid.IdBase64(), Op: "put", Diff: json}
+	expire := store.Change{Key: key, Id: sid.IdBase64(), Op: "expire", Diff: deadline}
+	for expire.Id <= put.Id {
+		expire.Id = sid.IdBase64()
+	}
+	_, err = g.Storage.Append([]store.Change{put, expire})
+	return err
+}
+
+// write checks the op against the rules before handing it to fn. The key is
+// locked throughout, so that another op on it can't be checked against the
+// document as it was before this one is written.
+func (g *Guard) write(key, op, json string, fn func(key, json string) error) error {
+	unlock := g.keys.lock(key)
+	defer unlock()
+
+	err := g.check(key, op, json)
+	if err != nil {
+		return err
+	}
+	return fn(key, json)
+}
+
+// check resolves the document as it would be after the op, making sure the op
+// follows the type rules for the document and that the result is valid against
+// every schema whose prefix matches the key.
+func (g *Guard) check(key, op, json string) error {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var prefixes []string
+	for prefix := range g.schemas {
+		if strings.HasPrefix(key, prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Strings(prefixes)
+
+	// only counters and schemas need to know what the document looks like now
+	counter := op == "inc" || op == "incby" || op == "max" || op == "min"
+	doc := store.NewDoc()
+	if counter || (len(prefixes) > 0 && op != "put" && op != "del") {
+		curr, err := store.Get(g.Storage, key)
+		if err != nil {
+			return err
+		}
+		// an expired document is already gone as far as the op is concerned
+		if curr != nil && !curr.Expired() {
+			doc = curr
+		}
+	}
+
+	change := store.Change{Key: key, Id: sid.IdBase64(), Op: op, Diff: json}
+	err := doc.Check(change)
+	if err != nil {
+		return &RejectedError{err.Error()}
+	}
+
+	if len(prefixes) == 0 || op == "del" {
+		return nil
+	}
+
+	err = doc.Apply(change)
+	if err != nil {
+		return &RejectedError{err.Error()}
+	}
+	for _, prefix := range prefixes {
+		err := g.schemas[prefix].Validate(doc.Value())
+		if err != nil {
+			return &RejectedError{"schema '" + prefix + "': " + err.Error()}
+		}
+	}
+
+	return nil
+}
+
+// keyLocks hands out a lock for each key, only keeping those currently held.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock waits for the key's lock, returning the function to unlock it.
+func (l *keyLocks) lock(key string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*keyLock{}
+	}
+	kl := l.locks[key]
+	if kl == nil {
+		kl = &keyLock{}
+		l.locks[key] = kl
+	}
+	kl.refs++
+	l.mu.Unlock()
+
+	kl.Lock()
+	return func() {
+		kl.Unlock()
+		l.mu.Lock()
+		kl.refs--
+		if kl.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/modb-dev/modb/store"
+	"github.com/modb-dev/modb/store/bbolt"
+)
+
+func TestGuardConcurrentIncBy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := bbolt.Open(filepath.Join(dir, "bbolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	guard, err := NewGuard(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = guard.PutSchema("counter:", `{"properties":{"n":{"type":"number","maximum":10}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every incby is checked against n being at most 10, so however they race
+	// only 10 can be written
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			guard.IncBy("counter:1", `{"n":1}`)
+		}()
+	}
+	wg.Wait()
+
+	doc, err := store.Get(db, "counter:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.String() != `{"n":10}` {
+		t.Errorf("got %s, want {\"n\":10}", doc.String())
+	}
+}
+
+func TestSchemaRejects(t *testing.T) {
+	client := testServer(t)
+	do(t, client, "schema", "set", "user:", `{"type":"object","required":["email"],"properties":{"n":{"type":"number","maximum":2}}}`)
+
+	rejected := func(args ...string) {
+		reply, err := client.Do(args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := reply.(ReplyError); !ok {
+			t.Errorf("%v = %v, want an error", args, reply)
+		}
+	}
+	rejected("put", "user:1", `{"n":1}`)
+	rejected("put", "user:1", `{"email":"a@example.com","n":3}`)
+
+	do(t, client, "put", "user:1", `{"email":"a@example.com","n":1}`)
+	do(t, client, "inc", "user:1", "n")
+	rejected("inc", "user:1", "n")
+	rejected("incby", "user:1", "n", "5")
+	do(t, client, "put", "team:1", `{"n":3}`)
+
+	if got := do(t, client, "get", "user:1"); got != `{"email":"a@example.com","n":2}` {
+		t.Errorf("get = %v", got)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/modb-dev/modb/store"
+	"github.com/valyala/fastjson"
+)
+
+// Index is the definition of a secondary index, mapping the value found at
+// Path in each document with a key starting with Prefix back to its key.
+type Index struct {
+	Name   string `json:"-"`
+	Prefix string `json:"prefix"`
+	Path   string `json:"path"`
+}
+
+// Indexer keeps the secondary indexes up to date as changes are written. Each
+// change is indexed by a worker rather than by the write itself, so an index can
+// briefly lag behind the documents it covers.
+type Indexer struct {
+	db      store.Storage
+	mu      sync.Mutex
+	indexes map[string]Index
+	worker  *worker
+}
+
+func NewIndexer(db store.Storage) (*Indexer, error) {
+	ix := &Indexer{
+		db:      db,
+		indexes: map[string]Index{},
+	}
+
+	var err error
+	iterErr := db.IterateIndexes(func(name, def string) {
+		index := Index{Name: name}
+		if jsonErr := json.Unmarshal([]byte(def), &index); jsonErr != nil && err == nil {
+			err = fmt.Errorf("index '%s': %s", name, jsonErr)
+		}
+		ix.indexes[name] = index
+	})
+	if iterErr != nil {
+		return nil, iterErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ix.worker = startWorker(db, ix.update)
+	return ix, nil
+}
+
+// Create defines a new index and fills it from the documents already stored.
+func (ix *Indexer) Create(name, prefix, path string) error {
+	if !store.ValidIndexName(name) {
+		return &RejectedError{"invalid index name '" + name + "'"}
+	}
+	if path == "" {
+		return &RejectedError{"missing path"}
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if _, exists := ix.indexes[name]; exists {
+		return &RejectedError{"index '" + name + "' already exists"}
+	}
+
+	index := Index{Name: name, Prefix: prefix, Path: path}
+	def, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	err = ix.db.PutIndex(name, string(def))
+	if err != nil {
+		return err
+	}
+	ix.indexes[name] = index
+
+	var entryErr error
+	err = store.GetRange(ix.db, prefix, prefix+"\xff", false, "", func(key string, doc *store.Doc) bool {
+		entryErr = ix.db.SetIndexEntry(name, key, indexValue(doc, path))
+		return entryErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return entryErr
+}
+
+// Drop removes an index and all of its entries.
+func (ix *Indexer) Drop(name string) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if _, exists := ix.indexes[name]; !exists {
+		return &RejectedError{"unknown index '" + name + "'"}
+	}
+
+	err := ix.db.DelIndex(name)
+	if err != nil {
+		return err
+	}
+	delete(ix.indexes, name)
+	return nil
+}
+
+// Get returns the index called name, if it exists.
+func (ix *Indexer) Get(name string) (Index, bool) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	index, ok := ix.indexes[name]
+	return index, ok
+}
+
+// List returns every index, ordered by name.
+func (ix *Indexer) List() []Index {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	var indexes []Index
+	for _, index := range ix.indexes {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].Name < indexes[j].Name })
+	return indexes
+}
+
+// Wait returns once every change written before it was called is indexed.
+func (ix *Indexer) Wait() {
+	ix.worker.Wait()
+}
+
+// Close stops following changes, once those already written are indexed.
+func (ix *Indexer) Close() {
+	ix.worker.Close()
+}
+
+// update re-indexes the changed document in every index covering its key. The
+// document is resolved afresh rather than from the change alone, so the index
+// always ends up agreeing with the latest version.
+func (ix *Indexer) update(change store.Change) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	var doc *store.Doc
+	for name, index := range ix.indexes {
+		if !strings.HasPrefix(change.Key, index.Prefix) {
+			continue
+		}
+
+		if doc == nil {
+			var err error
+			doc, err = store.Get(ix.db, change.Key)
+			if err != nil {
+				log.Printf("store.Get() - err: %s", err)
+				return
+			}
+			if doc == nil {
+				doc = store.NewDoc()
+			}
+		}
+
+		err := ix.db.SetIndexEntry(name, change.Key, indexValue(doc, index.Path))
+		if err != nil {
+			log.Printf("db.SetIndexEntry() - err: %s", err)
+		}
+	}
+}
+
+// indexValue returns the encoded value to index the document under, or an
+// empty string if it shouldn't be in the index at all.
+func indexValue(doc *store.Doc, path string) string {
+	if doc.Deleted() {
+		return ""
+	}
+	return store.IndexValue(store.IndexField(doc, path))
+}
+
+// parseIndexValue reads a value given on the command line as JSON, or failing
+// that as a plain string, and encodes it for the index.
+func parseIndexValue(arg string) string {
+	var p fastjson.Parser
+	val, err := p.Parse(arg)
+	if err != nil {
+		var a fastjson.Arena
+		val = a.NewString(arg)
+	}
+	return store.IndexValue(val)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// maxHistory is how many lines of history are kept.
+const maxHistory = 1000
+
+// lineEditor reads lines from a terminal in raw mode, with the usual keys for
+// moving around and editing the line, up and down for history, and tab to
+// complete the word before the cursor.
+type lineEditor struct {
+	fd      int
+	in      *bufio.Reader
+	out     io.Writer
+	history []string
+
+	// complete returns the words which could finish partial, given the words
+	// before it on the line.
+	complete func(words []string, partial string) []string
+}
+
+func newLineEditor(in *os.File, out io.Writer, complete func(words []string, partial string) []string) *lineEditor {
+	return &lineEditor{
+		fd:       int(in.Fd()),
+		in:       bufio.NewReader(in),
+		out:      out,
+		complete: complete,
+	}
+}
+
+// ReadLine reads a line, returning io.EOF on Ctrl-D at the start of a line.
+// Ctrl-C throws away the current line and starts again.
+func (e *lineEditor) ReadLine(prompt string) (string, error) {
+	restore, err := makeRaw(e.fd)
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+
+	var buf []rune
+	pos := 0
+	hist := len(e.history)
+	saved := ""
+	tabs := 0
+
+	refresh := func() {
+		fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(buf))
+		if n := len(buf) - pos; n > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", n)
+		}
+	}
+	setLine := func(line string) {
+		buf = []rune(line)
+		pos = len(buf)
+	}
+	insert := func(s string) {
+		rs := []rune(s)
+		buf = append(buf[:pos], append(rs, buf[pos:]...)...)
+		pos += len(rs)
+	}
+	up := func() {
+		if hist == 0 {
+			return
+		}
+		if hist == len(e.history) {
+			saved = string(buf)
+		}
+		hist--
+		setLine(e.history[hist])
+	}
+	down := func() {
+		if hist == len(e.history) {
+			return
+		}
+		hist++
+		if hist == len(e.history) {
+			setLine(saved)
+		} else {
+			setLine(e.history[hist])
+		}
+	}
+
+	refresh()
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		if r != '\t' {
+			tabs = 0
+		}
+
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			line := string(buf)
+			e.add(line)
+			return line, nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\r\n")
+			buf, pos, hist = nil, 0, len(e.history)
+		case 4: // Ctrl-D
+			if len(buf) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			if pos < len(buf) {
+				buf = append(buf[:pos], buf[pos+1:]...)
+			}
+		case 127, 8: // Backspace
+			if pos > 0 {
+				buf = append(buf[:pos-1], buf[pos:]...)
+				pos--
+			}
+		case 1: // Ctrl-A
+			pos = 0
+		case 5: // Ctrl-E
+			pos = len(buf)
+		case 2: // Ctrl-B
+			if pos > 0 {
+				pos--
+			}
+		case 6: // Ctrl-F
+			if pos < len(buf) {
+				pos++
+			}
+		case 11: // Ctrl-K
+			buf = buf[:pos]
+		case 21: // Ctrl-U
+			buf = append([]rune{}, buf[pos:]...)
+			pos = 0
+		case 23: // Ctrl-W
+			start := pos
+			for start > 0 && buf[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && buf[start-1] != ' ' {
+				start--
+			}
+			buf = append(buf[:start], buf[pos:]...)
+			pos = start
+		case 12: // Ctrl-L
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+		case 16: // Ctrl-P
+			up()
+		case 14: // Ctrl-N
+			down()
+		case '\t':
+			tabs++
+			e.tab(&buf, &pos, tabs)
+		case 27: // Esc, starting a sequence for the arrow keys and the like
+			switch e.escape() {
+			case "A":
+				up()
+			case "B":
+				down()
+			case "C":
+				if pos < len(buf) {
+					pos++
+				}
+			case "D":
+				if pos > 0 {
+					pos--
+				}
+			case "H", "1~", "7~":
+				pos = 0
+			case "F", "4~", "8~":
+				pos = len(buf)
+			case "3~":
+				if pos < len(buf) {
+					buf = append(buf[:pos], buf[pos+1:]...)
+				}
+			}
+		default:
+			if r >= ' ' {
+				insert(string(r))
+			}
+		}
+		refresh()
+	}
+}
+
+// escape reads the rest of an escape sequence after the Esc, returning what
+// follows the "[" or "O", such as "A" for up or "3~" for delete.
+func (e *lineEditor) escape() string {
+	r, _, err := e.in.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return ""
+	}
+	var seq []rune
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return ""
+		}
+		seq = append(seq, r)
+		if (r < '0' || r > '9') && r != ';' {
+			return string(seq)
+		}
+	}
+}
+
+// tab completes the word before the cursor. If there is more than one way to
+// finish it, as much as they share is filled in, and a second tab lists them.
+func (e *lineEditor) tab(buf *[]rune, pos *int, tabs int) {
+	if e.complete == nil {
+		return
+	}
+
+	before := string((*buf)[:*pos])
+	start := strings.LastIndex(before, " ") + 1
+	partial := before[start:]
+	candidates := e.complete(strings.Fields(before[:start]), partial)
+	if len(candidates) == 0 {
+		fmt.Fprint(e.out, "\a")
+		return
+	}
+
+	fill := candidates[0]
+	if len(candidates) == 1 {
+		fill += " "
+	} else {
+		for _, c := range candidates[1:] {
+			fill = commonPrefix(fill, c)
+		}
+	}
+	if len(fill) > len(partial) {
+		rs := []rune(fill[len(partial):])
+		*buf = append((*buf)[:*pos], append(rs, (*buf)[*pos:]...)...)
+		*pos += len(rs)
+		return
+	}
+
+	if tabs > 1 {
+		sort.Strings(candidates)
+		fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(candidates, "  "))
+	} else {
+		fmt.Fprint(e.out, "\a")
+	}
+}
+
+func (e *lineEditor) add(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if n := len(e.history); n > 0 && e.history[n-1] == line {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > maxHistory {
+		e.history = e.history[len(e.history)-maxHistory:]
+	}
+}
+
+// LoadHistory reads the history from a file, if there is one.
+func (e *lineEditor) LoadHistory(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		e.add(line)
+	}
+	return nil
+}
+
+// SaveHistory writes the history to a file.
+func (e *lineEditor) SaveHistory(filename string) error {
+	data := strings.Join(e.history, "\n") + "\n"
+	return ioutil.WriteFile(filename, []byte(data), 0600)
+}
+
+// commonPrefix returns the start that a and b share, matching case-insensitively
+// but keeping a's case.
+func commonPrefix(a, b string) string {
+	n := 0
+	for n < len(a) && n < len(b) && strings.EqualFold(a[n:n+1], b[n:n+1]) {
+		n++
+	}
+	return a[:n]
+}
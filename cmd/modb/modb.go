@@ -9,8 +9,26 @@ import (
 type Opts struct {
 	Command   string
 	Pathname  string
+	Args      []string
 	Datastore string
 	Help      bool
+	Out       string
+	From      string
+	To        string
+	Prefix    string
+	LogOnly   bool
+	DataOnly  bool
+	Repair    bool
+	Host      string
+	Port      int
+	Mix       string
+	Requests  int
+	Clients   int
+	Pipeline  int
+	Keys      int
+	Dist      string
+	Size      int
+	BackupDir string
 }
 
 func main() {
@@ -29,12 +47,30 @@ func main() {
 	flagSet := flag.NewFlagSet("", flag.ContinueOnError)
 	flagSet.StringVar(&opts.Datastore, "datastore", "bbolt", "the type of store to use; valid: bbolt, badger, level (default: bbolt)")
 	flagSet.BoolVar(&opts.Help, "help", false, "help for MoDB")
+	flagSet.StringVar(&opts.Out, "out", "", "file to write to instead of stdout")
+	flagSet.StringVar(&opts.From, "from", "", "datastore to read from, as <type>:<path>")
+	flagSet.StringVar(&opts.To, "to", "", "datastore to write to, as <type>:<path>")
+	flagSet.StringVar(&opts.Prefix, "prefix", "", "only include keys starting with this prefix")
+	flagSet.BoolVar(&opts.LogOnly, "log-only", false, "only include the log")
+	flagSet.BoolVar(&opts.DataOnly, "data-only", false, "only include the data")
+	flagSet.BoolVar(&opts.Repair, "repair", false, "quarantine any bad entries found")
+	flagSet.StringVar(&opts.Host, "host", "localhost", "host of the server to talk to")
+	flagSet.IntVar(&opts.Port, "port", 29876, "port of the server to talk to")
+	flagSet.StringVar(&opts.Mix, "mix", "put=20,inc=20,incby=10,del=5,get=45", "weights of each op to send")
+	flagSet.IntVar(&opts.Requests, "requests", 100000, "total number of ops to send")
+	flagSet.IntVar(&opts.Clients, "clients", 10, "number of connections sending ops at once")
+	flagSet.IntVar(&opts.Pipeline, "pipeline", 1, "number of ops each client sends before reading replies")
+	flagSet.IntVar(&opts.Keys, "keys", 10000, "size of the keyspace")
+	flagSet.StringVar(&opts.Dist, "dist", "uniform", "distribution of keys: uniform, zipfian")
+	flagSet.IntVar(&opts.Size, "size", 100, "size in bytes of the data in each put")
+	flagSet.StringVar(&opts.BackupDir, "backup-dir", "", "directory the server writes backups to")
 	flagSet.Parse(os.Args[2:])
 
 	// get any remaining args
 	args := flagSet.Args()
 	if len(args) > 0 {
 		opts.Pathname = args[0]
+		opts.Args = args[1:]
 	}
 
 	// call the correct command
@@ -51,6 +87,22 @@ func main() {
 		err = CmdServer(opts)
 	case "dump":
 		err = CmdDump(opts)
+	case "load":
+		err = CmdLoad(opts)
+	case "migrate":
+		err = CmdMigrate(opts)
+	case "restore":
+		err = CmdRestore(opts)
+	case "verify":
+		err = CmdVerify(opts)
+	case "cli":
+		err = CmdCli(opts)
+	case "bench":
+		err = CmdBench(opts)
+	case "inspect":
+		err = CmdInspect(opts)
+	case "diff":
+		err = CmdDiff(opts)
 	default:
 		err = CmdHelp("Unknown command", opts)
 	}
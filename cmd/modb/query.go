@@ -0,0 +1,239 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/modb-dev/modb/query"
+	"github.com/modb-dev/modb/store"
+	"github.com/tidwall/redcon"
+	"github.com/valyala/fastjson"
+)
+
+// indexRange is a span of encoded values to read from an index, where an empty
+// end has no upper bound.
+type indexRange struct {
+	start string
+	end   string
+}
+
+func Query(indexer *Indexer, db store.Storage, conn redcon.Conn, args ...[]byte) {
+	// Usage:
+	// > query users: WHERE age >= 18 AND country IN (nz, au) FIELDS name,email LIMIT 10
+	//
+	// Replies with [key, json] pairs for each document under the prefix which
+	// matches the expression, in key order. The expression may be given as one
+	// argument or spread across several. When part of it compares a field which
+	// an index covers, only the keys found in that index are read, otherwise
+	// every document under the prefix is.
+
+	if len(args) < 1 {
+		conn.WriteError("ERR wrong number of arguments: query <prefix> [WHERE <expr>] [FIELDS <path,...>] [LIMIT <n>]")
+		return
+	}
+
+	prefix := string(args[0])
+	var where []string
+	var fields []string
+	limit := 0
+	clause := ""
+	for _, arg := range args[1:] {
+		word := strings.ToLower(string(arg))
+		if word == "where" || word == "fields" || word == "limit" {
+			clause = word
+			continue
+		}
+		switch clause {
+		case "where":
+			where = append(where, string(arg))
+		case "fields":
+			for _, field := range strings.Split(string(arg), ",") {
+				if field != "" {
+					fields = append(fields, field)
+				}
+			}
+		case "limit":
+			n, err := strconv.Atoi(string(arg))
+			if err != nil || n < 1 {
+				conn.WriteError("ERR invalid limit '" + string(arg) + "'")
+				return
+			}
+			limit = n
+		default:
+			conn.WriteError("ERR syntax error near '" + string(arg) + "'")
+			return
+		}
+	}
+
+	var expr query.Expr = query.And{}
+	if clause != "" && len(where) > 0 {
+		var err error
+		expr, err = query.Parse(strings.Join(where, " "))
+		if err != nil {
+			conn.WriteError("ERR invalid expression: " + err.Error())
+			return
+		}
+	}
+
+	var keys []string
+	var docs []*store.Doc
+	matches := func(key string, doc *store.Doc) bool {
+		if doc.Deleted() || !expr.Eval(doc.Value()) {
+			return true
+		}
+		keys = append(keys, key)
+		docs = append(docs, doc)
+		return limit == 0 || len(docs) < limit
+	}
+
+	name, ranges := plan(indexer, prefix, expr)
+	if name != "" {
+		indexer.Wait()
+		candidates, err := indexKeys(db, name, prefix, ranges)
+		if err != nil {
+			log.Printf("db.IterateIndex() - err: %s", err)
+			conn.WriteError("ERR reading from datastore")
+			return
+		}
+		for _, key := range candidates {
+			doc, err := store.Get(db, key)
+			if err != nil {
+				log.Printf("store.Get() - err: %s", err)
+				conn.WriteError("ERR reading from datastore")
+				return
+			}
+			if doc != nil && !matches(key, doc) {
+				break
+			}
+		}
+	} else {
+		err := store.GetRange(db, prefix, prefix+"\xff", false, "", matches)
+		if err != nil {
+			log.Printf("store.GetRange() - err: %s", err)
+			conn.WriteError("ERR reading from datastore")
+			return
+		}
+	}
+
+	conn.WriteArray(len(docs))
+	for i, doc := range docs {
+		json := doc.String()
+		if len(fields) > 0 {
+			json = project(doc, fields)
+		}
+		conn.WriteArray(2)
+		conn.WriteBulkString(keys[i])
+		conn.WriteBulkString(json)
+	}
+}
+
+// plan looks for a part of the expression which every match must satisfy and
+// which an index covering the whole prefix can answer. It returns the index
+// name and the ranges of values to read, or an empty name to scan instead.
+func plan(indexer *Indexer, prefix string, expr query.Expr) (string, []indexRange) {
+	indexes := indexer.List()
+	for _, e := range query.Conjuncts(expr) {
+		var path string
+		var ranges []indexRange
+		switch e := e.(type) {
+		case query.Compare:
+			path = e.Path
+			r, ok := compareRange(e.Op, e.Value)
+			if !ok {
+				continue
+			}
+			ranges = []indexRange{r}
+		case query.In:
+			path = e.Path
+			for _, val := range e.Values {
+				r, _ := compareRange("=", val)
+				ranges = append(ranges, r)
+			}
+		default:
+			continue
+		}
+
+		for _, index := range indexes {
+			if index.Path == path && strings.HasPrefix(prefix, index.Prefix) {
+				return index.Name, ranges
+			}
+		}
+	}
+	return "", nil
+}
+
+// compareRange gives the span of encoded index values which satisfy the
+// comparison. Entries are "<value>\x00<key>", so "\x01" after a value takes in
+// every key with that value. Ordering stays within the value's own type, which
+// is the first byte of its encoding.
+func compareRange(op string, val *fastjson.Value) (indexRange, bool) {
+	enc := store.IndexValue(val)
+	if op == "=" {
+		return indexRange{enc, enc + "\x01"}, true
+	}
+	if val.Type() != fastjson.TypeNumber && val.Type() != fastjson.TypeString {
+		return indexRange{}, false
+	}
+
+	lo := enc[:1]
+	hi := string(enc[0] + 1)
+	switch op {
+	case "<":
+		return indexRange{lo, enc}, true
+	case "<=":
+		return indexRange{lo, enc + "\x01"}, true
+	case ">":
+		return indexRange{enc + "\x01", hi}, true
+	case ">=":
+		return indexRange{enc, hi}, true
+	}
+	return indexRange{}, false
+}
+
+// indexKeys reads the keys under prefix found in the ranges of the index, in
+// key order and without duplicates.
+func indexKeys(db store.Storage, name, prefix string, ranges []indexRange) ([]string, error) {
+	seen := map[string]bool{}
+	var keys []string
+	for _, r := range ranges {
+		err := db.IterateIndex(name, r.start, r.end, func(value, key string) bool {
+			if strings.HasPrefix(key, prefix) && !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// project returns a document holding only the given fields, in the order
+// given, leaving out any which aren't present.
+func project(doc *store.Doc, fields []string) string {
+	var a fastjson.Arena
+	out := a.NewObject()
+	for _, field := range fields {
+		val := query.Field(doc.Value(), field)
+		if val == nil {
+			continue
+		}
+		path := strings.Split(field, ".")
+		obj := out
+		for _, name := range path[:len(path)-1] {
+			next := obj.Get(name)
+			if next == nil || next.Type() != fastjson.TypeObject {
+				next = a.NewObject()
+				obj.Set(name, next)
+			}
+			obj = next
+		}
+		obj.Set(path[len(path)-1], val)
+	}
+	return out.String()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/modb-dev/modb/store"
+	"github.com/modb-dev/modb/store/bbolt"
+)
+
+// testServer starts a client server on a fresh datastore, returning a client
+// connected to it.
+func testServer(t *testing.T) *Client {
+	dir, err := ioutil.TempDir("", "modb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bbolt.Open(filepath.Join(dir, "bbolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	guard, err := NewGuard(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexer, err := NewIndexer(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	views, err := NewViews(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewClientServer("", guard, indexer, views, dir)
+	go server.Serve(ln)
+
+	client, err := Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+		views.Close()
+		indexer.Close()
+		db.Close()
+		os.RemoveAll(dir)
+	})
+	return client
+}
+
+// testStore opens a fresh datastore, closed and removed once the test is done.
+func testStore(t *testing.T) store.Storage {
+	dir, err := ioutil.TempDir("", "modb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bbolt.Open(filepath.Join(dir, "bbolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+	return db
+}
+
+func do(t *testing.T, client *Client, args ...string) interface{} {
+	reply, err := client.Do(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, ok := reply.(ReplyError); ok {
+		t.Fatalf("%v: %s", args, err)
+	}
+	return reply
+}
+
+// putUsers writes more than one batch of 100 documents, with keys where the
+// log's key:id order isn't key order, returning the keys in key order.
+func putUsers(t *testing.T, client *Client) []string {
+	var keys []string
+	for i := 0; i < 150; i++ {
+		key := "user:" + strconv.Itoa(i)
+		do(t, client, "put", key, `{"n":`+strconv.Itoa(i)+`,"team":"`+strconv.Itoa(i%3)+`"}`)
+		keys = append(keys, key)
+	}
+	do(t, client, "put", "user:1-x", `{"n":1000,"team":"0"}`)
+	keys = append(keys, "user:1-x")
+	do(t, client, "put", "users", `{"n":5000,"team":"0"}`)
+	sort.Strings(keys)
+	return keys
+}
+
+func replyKeys(reply interface{}) []string {
+	var keys []string
+	for _, pair := range reply.([]interface{}) {
+		keys = append(keys, pair.([]interface{})[0].(string))
+	}
+	return keys
+}
+
+func TestQueryScan(t *testing.T) {
+	client := testServer(t)
+	keys := putUsers(t, client)
+
+	got := replyKeys(do(t, client, "query", "user:", "WHERE", "n >= 0"))
+	if !reflect.DeepEqual(got, keys) {
+		t.Errorf("query gave %d keys %v, want %d keys %v", len(got), got, len(keys), keys)
+	}
+
+	got = replyKeys(do(t, client, "query", "user:1", "LIMIT", "3"))
+	want := []string{"user:1", "user:1-x", "user:10"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("query with limit gave %v, want %v", got, want)
+	}
+}
+
+func TestQueryIndex(t *testing.T) {
+	client := testServer(t)
+	putUsers(t, client)
+	do(t, client, "index", "create", "byteam", "user:", "team")
+
+	got := replyKeys(do(t, client, "query", "user:", "WHERE", `team = "1"`))
+	if len(got) != 50 {
+		t.Errorf("query by index gave %d keys, want 50", len(got))
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ReplyError is an error reply from the server, such as "ERR unknown command".
+type ReplyError string
+
+func (e ReplyError) Error() string {
+	return string(e)
+}
+
+// Status is a simple string reply, such as "OK".
+type Status string
+
+// Client talks RESP to a server. Commands can be sent one at a time with Do, or
+// pipelined by calling Send several times then Flush, then Receive once for
+// each. Replies are a Status, ReplyError, int64, string (for a bulk string),
+// nil (for a null) or []interface{} of these.
+type Client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func Dial(addr string) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}, nil
+}
+
+// Send buffers a command to be sent by the next Flush.
+func (c *Client) Send(args ...string) {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+func (c *Client) Flush() error {
+	return c.w.Flush()
+}
+
+// Receive reads the next reply. An error reply is returned as the reply, not
+// as the error, which is kept for failures of the connection itself.
+func (c *Client) Receive() (interface{}, error) {
+	line, err := c.line()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return Status(line[1:]), nil
+	case '-':
+		return ReplyError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk length '%s'", line[1:])
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(c.r, buf)
+		if err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid array length '%s'", line[1:])
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		arr := make([]interface{}, n)
+		for i := range arr {
+			arr[i], err = c.Receive()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	}
+	return nil, fmt.Errorf("unknown reply type '%c'", line[0])
+}
+
+// Do sends a command and waits for its reply.
+func (c *Client) Do(args ...string) (interface{}, error) {
+	c.Send(args...)
+	err := c.Flush()
+	if err != nil {
+		return nil, err
+	}
+	return c.Receive()
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// line reads a line without its CRLF.
+func (c *Client) line() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("invalid reply line '%s'", line)
+	}
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScanPaging(t *testing.T) {
+	client := testServer(t)
+	keys := []string{"user", "user:1", "user:10", "user:1:x", "user:a", "users"}
+	for _, key := range keys {
+		// two ops each, so keys have more than one log entry
+		do(t, client, "put", key, `{"n":1}`)
+		do(t, client, "inc", key, "n")
+	}
+
+	for _, count := range []string{"1", "2", "10"} {
+		var got []string
+		cursor := "0"
+		for i := 0; i <= len(keys); i++ {
+			reply := do(t, client, "scan", cursor, "COUNT", count).([]interface{})
+			for _, key := range reply[1].([]interface{}) {
+				got = append(got, key.(string))
+			}
+			cursor = reply[0].(string)
+			if cursor == "0" {
+				break
+			}
+		}
+		if cursor != "0" {
+			t.Errorf("scan with count %s didn't finish", count)
+		}
+		if !reflect.DeepEqual(got, keys) {
+			t.Errorf("scan with count %s gave %v, want %v", count, got, keys)
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/modb-dev/modb/query"
+	"github.com/modb-dev/modb/store"
+	"github.com/valyala/fastjson"
+)
+
+// View is the definition of a materialized view, which reduces the value at
+// Path in each document with a key starting with Prefix into a total for the
+// group given by the value at Group (or a single total if there's no Group).
+type View struct {
+	Name   string `json:"-"`
+	Prefix string `json:"prefix"`
+	Group  string `json:"group,omitempty"`
+	Path   string `json:"path"`
+	Reduce string `json:"reduce"`
+
+	entries  map[string]*viewEntry
+	groups   map[string]*viewGroup
+	expiring map[string]bool // keys whose entries have a deadline
+}
+
+// viewEntry is what a single document contributes to a view, as of the op id
+// last, the largest of the ids it has taken into account. A change may be
+// notified after the document was re-resolved with it already applied, so a
+// change with an id up to last can't be applied as a delta.
+type viewEntry struct {
+	group   string
+	num     bool
+	value   float64
+	expires time.Time
+	last    string
+}
+
+// viewGroup is the running total for a group. Once the largest value has been
+// taken away, max is only an upper bound until it is worked out again.
+type viewGroup struct {
+	count int
+	nums  int
+	sum   float64
+	max   float64
+	stale bool
+}
+
+// def returns a copy of the view's definition, without its results.
+func (v *View) def() View {
+	return View{Name: v.Name, Prefix: v.Prefix, Group: v.Group, Path: v.Path, Reduce: v.Reduce}
+}
+
+// MapExpr gives the view's map expression, `[group-path=]value-path`.
+func (v *View) MapExpr() string {
+	if v.Group == "" {
+		return v.Path
+	}
+	return v.Group + "=" + v.Path
+}
+
+// Views keeps each view up to date as changes are written. Counter ops are
+// applied to a view as a delta straight from the change, whilst anything else
+// re-resolves the document and swaps its old contribution for the new one. This
+// is done by a worker rather than by the write itself, so a view can briefly
+// lag behind the documents it covers.
+type Views struct {
+	db     store.Storage
+	mu     sync.Mutex
+	views  map[string]*View
+	worker *worker
+}
+
+func NewViews(db store.Storage) (*Views, error) {
+	vs := &Views{
+		db:    db,
+		views: map[string]*View{},
+	}
+
+	var err error
+	iterErr := db.IterateViews(func(name, def string) {
+		view := &View{Name: name}
+		if jsonErr := json.Unmarshal([]byte(def), view); jsonErr != nil && err == nil {
+			err = fmt.Errorf("view '%s': %s", name, jsonErr)
+		}
+		vs.views[name] = view
+	})
+	if iterErr != nil {
+		return nil, iterErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// views are only held in memory, so are built afresh each time, listening
+	// first so that no change is missed in between
+	vs.mu.Lock()
+	vs.worker = startWorker(db, vs.update)
+	for _, view := range vs.views {
+		err = vs.build(view)
+		if err != nil {
+			break
+		}
+	}
+	vs.mu.Unlock()
+
+	if err != nil {
+		vs.worker.Close()
+		return nil, err
+	}
+	return vs, nil
+}
+
+// Create defines a new view and builds it from the documents already stored.
+func (vs *Views) Create(name, prefix, mapExpr, reduce string) error {
+	if !store.ValidIndexName(name) {
+		return &RejectedError{"invalid view name '" + name + "'"}
+	}
+	reduce = strings.ToLower(reduce)
+	if reduce != "sum" && reduce != "count" && reduce != "max" {
+		return &RejectedError{"unknown reduce '" + reduce + "'"}
+	}
+
+	view := &View{Name: name, Prefix: prefix, Path: mapExpr, Reduce: reduce}
+	if i := strings.Index(mapExpr, "="); i != -1 {
+		view.Group = mapExpr[:i]
+		view.Path = mapExpr[i+1:]
+		if view.Group == "" {
+			return &RejectedError{"missing group path"}
+		}
+	}
+	if view.Path == "" {
+		return &RejectedError{"missing path"}
+	}
+
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	if _, exists := vs.views[name]; exists {
+		return &RejectedError{"view '" + name + "' already exists"}
+	}
+
+	def, err := json.Marshal(view)
+	if err != nil {
+		return err
+	}
+	err = vs.build(view)
+	if err != nil {
+		return err
+	}
+	err = vs.db.PutView(name, string(def))
+	if err != nil {
+		return err
+	}
+	vs.views[name] = view
+	return nil
+}
+
+// Drop removes a view.
+func (vs *Views) Drop(name string) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	if _, exists := vs.views[name]; !exists {
+		return &RejectedError{"unknown view '" + name + "'"}
+	}
+
+	err := vs.db.DelView(name)
+	if err != nil {
+		return err
+	}
+	delete(vs.views, name)
+	return nil
+}
+
+// List returns every view, ordered by name.
+func (vs *Views) List() []View {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	var views []View
+	for _, view := range vs.views {
+		views = append(views, view.def())
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].Name < views[j].Name })
+	return views
+}
+
+// ViewResult is the reduced value for one group of a view, where Ok is false
+// if there were no numbers to take the max of.
+type ViewResult struct {
+	Group string
+	Value float64
+	Ok    bool
+}
+
+// Results returns the view's definition and the current value of each of its
+// groups, ordered by group, once every change written before it was called has
+// been applied.
+func (vs *Views) Results(name string) (View, []ViewResult, error) {
+	vs.worker.Wait()
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	view, ok := vs.views[name]
+	if !ok {
+		return View{}, nil, &RejectedError{"unknown view '" + name + "'"}
+	}
+	view.expire(time.Now())
+
+	var results []ViewResult
+	for group := range view.groups {
+		n, ok := view.result(group)
+		results = append(results, ViewResult{group, n, ok})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Group < results[j].Group })
+	return view.def(), results, nil
+}
+
+// Close stops following changes, once those already written are applied.
+func (vs *Views) Close() {
+	vs.worker.Close()
+}
+
+// build fills the view from every document under its prefix.
+func (vs *Views) build(view *View) error {
+	view.entries = map[string]*viewEntry{}
+	view.groups = map[string]*viewGroup{}
+	view.expiring = map[string]bool{}
+
+	var keys []string
+	err := vs.db.IterateRange(view.Prefix, view.Prefix+"\xff", false, func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		doc, last, err := vs.resolve(key)
+		if err != nil {
+			return err
+		}
+		view.set(key, view.entry(doc, last))
+	}
+	return nil
+}
+
+// update applies the change to every view covering its key.
+func (vs *Views) update(change store.Change) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	var doc *store.Doc
+	var last string
+	for _, view := range vs.views {
+		if !strings.HasPrefix(change.Key, view.Prefix) {
+			continue
+		}
+
+		if view.delta(change) {
+			continue
+		}
+
+		if doc == nil {
+			var err error
+			doc, last, err = vs.resolve(change.Key)
+			if err != nil {
+				log.Printf("views.resolve() - err: %s", err)
+				return
+			}
+		}
+		view.set(change.Key, view.entry(doc, last))
+	}
+}
+
+// resolve replays the key's changes, also returning the largest of their ids.
+func (vs *Views) resolve(key string) (*store.Doc, string, error) {
+	var changes []store.Change
+	last := ""
+	err := vs.db.IterateChanges(key, func(change store.Change) {
+		changes = append(changes, change)
+		if change.Id > last {
+			last = change.Id
+		}
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if len(changes) == 0 {
+		return store.NewDoc(), last, nil
+	}
+
+	doc, err := store.Replay(changes)
+	return doc, last, err
+}
+
+// delta applies an inc or incby straight to the document's contribution, and
+// reports whether it could. It can't if the document doesn't contribute yet,
+// if the op may already be counted, if it has expired by the time of the op,
+// or if the op touches the group.
+func (v *View) delta(change store.Change) bool {
+	if change.Op != "inc" && change.Op != "incby" {
+		return false
+	}
+	old := v.entries[change.Key]
+	if old == nil || !old.num {
+		return false
+	}
+	if change.Id <= old.last {
+		// either read when the document was last resolved, or a change from
+		// elsewhere arriving late, which only resolving again can tell apart
+		return false
+	}
+	if !old.expires.IsZero() {
+		t, err := store.IdTime(change.Id)
+		if err != nil || !t.Before(old.expires) {
+			return false
+		}
+	}
+
+	var p fastjson.Parser
+	diff, err := p.Parse(change.Diff)
+	if err != nil {
+		return false
+	}
+	if v.Group != "" && query.Field(diff, v.Group) != nil {
+		return false
+	}
+
+	val := query.Field(diff, v.Path)
+	if val == nil {
+		old.last = change.Id
+		return true
+	}
+	var n float64
+	switch val.Type() {
+	case fastjson.TypeTrue:
+		n = 1
+	case fastjson.TypeNumber:
+		n = val.GetFloat64()
+	default:
+		return false
+	}
+
+	v.set(change.Key, &viewEntry{group: old.group, num: true, value: old.value + n, expires: old.expires, last: change.Id})
+	return true
+}
+
+// entry returns what the document contributes to the view, or nil if nothing.
+func (v *View) entry(doc *store.Doc, last string) *viewEntry {
+	if doc.Deleted() {
+		return nil
+	}
+
+	e := &viewEntry{expires: doc.Expires(), last: last}
+	if v.Group != "" {
+		group := query.Field(doc.Value(), v.Group)
+		if group == nil {
+			return nil
+		}
+		e.group = groupName(group)
+	}
+
+	val := query.Field(doc.Value(), v.Path)
+	if val == nil {
+		return nil
+	}
+	if val.Type() == fastjson.TypeNumber {
+		e.num = true
+		e.value = val.GetFloat64()
+	}
+	return e
+}
+
+// set replaces the key's contribution to the view.
+func (v *View) set(key string, e *viewEntry) {
+	if old := v.entries[key]; old != nil {
+		delete(v.entries, key)
+		delete(v.expiring, key)
+		g := v.groups[old.group]
+		g.count--
+		if old.num {
+			g.nums--
+			g.sum -= old.value
+			if old.value >= g.max {
+				g.stale = true
+			}
+		}
+		if g.count == 0 {
+			delete(v.groups, old.group)
+		}
+	}
+
+	if e == nil {
+		return
+	}
+	v.entries[key] = e
+	if !e.expires.IsZero() {
+		v.expiring[key] = true
+	}
+	g := v.groups[e.group]
+	if g == nil {
+		g = &viewGroup{}
+		v.groups[e.group] = g
+	}
+	g.count++
+	if e.num {
+		g.nums++
+		g.sum += e.value
+		// a stale max is still at least every other value, so anything
+		// reaching it is the max again
+		if g.nums == 1 || e.value >= g.max {
+			g.max = e.value
+			g.stale = false
+		}
+	}
+}
+
+// expire takes away what each document which has expired by now contributed,
+// since nothing is written when a deadline passes for the view to follow.
+func (v *View) expire(now time.Time) {
+	for key := range v.expiring {
+		if !now.Before(v.entries[key].expires) {
+			v.set(key, nil)
+		}
+	}
+}
+
+// result returns the reduced value of the group.
+func (v *View) result(group string) (float64, bool) {
+	g := v.groups[group]
+	if g == nil {
+		return 0, v.Reduce != "max"
+	}
+
+	switch v.Reduce {
+	case "sum":
+		return g.sum, true
+	case "count":
+		return float64(g.count), true
+	}
+
+	if g.nums == 0 {
+		return 0, false
+	}
+	if g.stale {
+		g.max, g.stale = 0, false
+		first := true
+		for _, e := range v.entries {
+			if e.group == group && e.num && (first || e.value > g.max) {
+				g.max = e.value
+				first = false
+			}
+		}
+	}
+	return g.max, true
+}
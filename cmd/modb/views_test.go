@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestViews(t *testing.T) {
+	client := testServer(t)
+	putUsers(t, client)
+	do(t, client, "view", "create", "byteam", "user:", "team=n", "sum")
+
+	// deltas, then a change which re-resolves, then deltas again
+	for i := 0; i < 10; i++ {
+		do(t, client, "incby", "user:1", "n", "10")
+	}
+	do(t, client, "max", "user:1", "n", "1000")
+	do(t, client, "inc", "user:1", "n")
+	do(t, client, "del", "user:1-x")
+
+	// team 0 is 0+3+...+147, team 1 is 1+4+...+148 then user:1 going from 1 to
+	// 1001, and team 2 is 2+5+...+149
+	got := do(t, client, "view", "get", "byteam")
+	want := []interface{}{
+		[]interface{}{"0", "3675"},
+		[]interface{}{"1", "4725"},
+		[]interface{}{"2", "3775"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("view get = %v, want %v", got, want)
+	}
+}
+
+func TestExpiredHidden(t *testing.T) {
+	client := testServer(t)
+	do(t, client, "index", "create", "byteam", "user:", "team")
+	do(t, client, "view", "create", "count", "user:", "team=n", "count")
+	do(t, client, "put", "user:1", `{"n":1,"team":"a"}`)
+	do(t, client, "put", "user:2", `{"n":2,"team":"a"}`, "EX", "0.2")
+
+	reply := do(t, client, "get", "user:2")
+	if reply != `{"n":2,"team":"a"}` {
+		t.Fatalf("get before expiry = %v", reply)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	got := do(t, client, "index", "query", "byteam", "a")
+	if want := []interface{}{"user:1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("index query = %v, want %v", got, want)
+	}
+	got = do(t, client, "view", "get", "count")
+	if want := []interface{}{[]interface{}{"a", "1"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("view get = %v, want %v", got, want)
+	}
+}
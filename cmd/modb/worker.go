@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/modb-dev/modb/store"
+)
+
+// worker follows the changes written to the datastore and hands them, in the
+// order they were notified, to fn on a goroutine of its own, so that the write
+// doesn't wait whilst fn reads or writes the datastore. Unlike a feed nothing is
+// dropped if fn falls behind, since indexes and views need every change, so the
+// queue has no bound.
+type worker struct {
+	mu      sync.Mutex
+	changes []store.Change
+	queued  int
+	handled int
+	caught  *sync.Cond
+	closed  bool
+	wake    chan struct{}
+	done    chan struct{}
+	stop    func()
+}
+
+func startWorker(db store.Storage, fn func(change store.Change)) *worker {
+	w := &worker{
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	w.caught = sync.NewCond(&w.mu)
+	w.stop = db.Listen(w.add)
+	go w.run(fn)
+	return w
+}
+
+// add queues the change, without blocking.
+func (w *worker) add(change store.Change) {
+	w.mu.Lock()
+	w.changes = append(w.changes, change)
+	w.queued++
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *worker) run(fn func(change store.Change)) {
+	defer close(w.done)
+	for {
+		w.mu.Lock()
+		changes, closed := w.changes, w.closed
+		w.changes = nil
+		w.mu.Unlock()
+
+		for _, change := range changes {
+			fn(change)
+		}
+		w.mu.Lock()
+		w.handled += len(changes)
+		w.caught.Broadcast()
+		w.mu.Unlock()
+
+		if closed && len(changes) == 0 {
+			return
+		}
+		if len(changes) == 0 {
+			<-w.wake
+		}
+	}
+}
+
+// Wait returns once every change notified before it was called has been
+// handled, so that a read can see the writes which came before it.
+func (w *worker) Wait() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	queued := w.queued
+	for w.handled < queued {
+		w.caught.Wait()
+	}
+}
+
+// Close stops following changes, and waits for those already queued to be
+// handled.
+func (w *worker) Close() {
+	w.stop()
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	<-w.done
+}
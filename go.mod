@@ -10,8 +10,10 @@ require (
 	github.com/oklog/run v1.0.0
 	github.com/stretchr/testify v1.3.0 // indirect
 	github.com/syndtr/goleveldb v1.0.0
+	github.com/tidwall/match v0.0.0-20171002075945-1731857f09b1
 	github.com/tidwall/redcon v1.0.0
 	github.com/tidwall/sjson v1.0.4
 	github.com/valyala/fastjson v1.4.1
 	go.etcd.io/bbolt v1.3.2
+	golang.org/x/sys v0.0.0-20180927150500-dad3d9fb7b6e
 )
@@ -0,0 +1,275 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+type kind int
+
+const (
+	word kind = iota
+	quoted
+	op
+	lparen
+	rparen
+	comma
+)
+
+type token struct {
+	kind kind
+	text string
+}
+
+// lex splits src into tokens.
+func lex(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{lparen, "("})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{rparen, ")"})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{comma, ","})
+			i++
+		case c == '=' || c == '!' || c == '<' || c == '>':
+			j := i + 1
+			if j < len(src) && src[j] == '=' {
+				j++
+			}
+			text := src[i:j]
+			if text == "!" {
+				return nil, fmt.Errorf("unexpected '!'")
+			}
+			if text == "==" {
+				text = "="
+			}
+			tokens = append(tokens, token{op, text})
+			i = j
+		case c == '\'' || c == '"':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(src) && src[j] != c; j++ {
+				if src[j] == '\\' && j+1 < len(src) {
+					j++
+				}
+				b.WriteByte(src[j])
+			}
+			if j == len(src) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, token{quoted, b.String()})
+			i = j + 1
+		default:
+			j := i
+			for j < len(src) && !strings.ContainsRune(" \t\n\r(),=!<>'\"", rune(src[j])) {
+				j++
+			}
+			tokens = append(tokens, token{word, src[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// parser is a recursive descent parser over the tokens, where OR binds more
+// loosely than AND, which binds more loosely than NOT.
+type parser struct {
+	tokens []token
+	pos    int
+	arena  fastjson.Arena
+}
+
+func (p *parser) peek() *token {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+func (p *parser) next() (token, error) {
+	t := p.peek()
+	if t == nil {
+		return token{}, fmt.Errorf("unexpected end of expression")
+	}
+	p.pos++
+	return *t, nil
+}
+
+// keyword reports (and consumes) the next token if it is the keyword kw.
+func (p *parser) keyword(kw string) bool {
+	t := p.peek()
+	if t != nil && t.kind == word && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(k kind, text string) error {
+	t, err := p.next()
+	if err != nil {
+		return err
+	}
+	if t.kind != k {
+		return fmt.Errorf("expected '%s' but got '%s'", text, t.text)
+	}
+	return nil
+}
+
+func (p *parser) or() (Expr, error) {
+	e, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	exprs := Or{e}
+	for p.keyword("or") {
+		e, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return exprs, nil
+}
+
+func (p *parser) and() (Expr, error) {
+	e, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	exprs := And{e}
+	for p.keyword("and") {
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return exprs, nil
+}
+
+func (p *parser) not() (Expr, error) {
+	if p.keyword("not") {
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return Not{e}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (Expr, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	if t.kind == lparen {
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(rparen, ")")
+	}
+
+	if t.kind != word {
+		return nil, fmt.Errorf("expected a field but got '%s'", t.text)
+	}
+
+	if strings.EqualFold(t.text, "exists") {
+		if next := p.peek(); next != nil && next.kind == lparen {
+			p.pos++
+			path, err := p.next()
+			if err != nil {
+				return nil, err
+			}
+			if path.kind != word {
+				return nil, fmt.Errorf("expected a field but got '%s'", path.text)
+			}
+			return Exists{path.text}, p.expect(rparen, ")")
+		}
+	}
+
+	path := t.text
+	if p.keyword("in") {
+		err := p.expect(lparen, "(")
+		if err != nil {
+			return nil, err
+		}
+		in := In{Path: path}
+		for {
+			val, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			in.Values = append(in.Values, val)
+			t, err := p.next()
+			if err != nil {
+				return nil, err
+			}
+			if t.kind == rparen {
+				return in, nil
+			}
+			if t.kind != comma {
+				return nil, fmt.Errorf("expected ',' or ')' but got '%s'", t.text)
+			}
+		}
+	}
+
+	o, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if o.kind != op {
+		return nil, fmt.Errorf("expected a comparison after '%s' but got '%s'", path, o.text)
+	}
+	val, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	return Compare{Path: path, Op: o.text, Value: val}, nil
+}
+
+func (p *parser) value() (*fastjson.Value, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	if t.kind == quoted {
+		return p.arena.NewString(t.text), nil
+	}
+	if t.kind != word {
+		return nil, fmt.Errorf("expected a value but got '%s'", t.text)
+	}
+
+	switch t.text {
+	case "true":
+		return p.arena.NewTrue(), nil
+	case "false":
+		return p.arena.NewFalse(), nil
+	case "null":
+		return p.arena.NewNull(), nil
+	}
+	if n, err := strconv.ParseFloat(t.text, 64); err == nil {
+		return p.arena.NewNumberFloat64(n), nil
+	}
+	return p.arena.NewString(t.text), nil
+}
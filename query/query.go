@@ -0,0 +1,191 @@
+// Package query parses and evaluates the filter expressions used by `query`.
+//
+// An expression compares fields in a document with values, and may combine
+// these with AND, OR, NOT and parentheses:
+//
+//	age >= 18 AND (country = 'nz' OR country IN ('au', 'uk'))
+//	exists(email) AND NOT verified = true
+//
+// Fields are dotted paths into the document. Values are numbers, strings (in
+// single or double quotes), true, false or null. A bare word on the right of
+// a comparison is taken as a string. Comparisons against a missing field are
+// always false, and ordering only applies between two numbers or two strings.
+package query
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+// Expr is a parsed expression.
+type Expr interface {
+	// Eval reports whether the document matches the expression.
+	Eval(doc *fastjson.Value) bool
+}
+
+// And matches when all of its expressions match.
+type And []Expr
+
+// Or matches when any of its expressions match.
+type Or []Expr
+
+// Not matches when its expression doesn't.
+type Not struct {
+	Expr Expr
+}
+
+// Exists matches when the field is present, whatever its value.
+type Exists struct {
+	Path string
+}
+
+// Compare matches when the field compares with the value using Op, which is
+// one of "=", "!=", "<", "<=", ">" or ">=".
+type Compare struct {
+	Path  string
+	Op    string
+	Value *fastjson.Value
+}
+
+// In matches when the field is equal to any of the values.
+type In struct {
+	Path   string
+	Values []*fastjson.Value
+}
+
+func (e And) Eval(doc *fastjson.Value) bool {
+	for _, sub := range e {
+		if !sub.Eval(doc) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e Or) Eval(doc *fastjson.Value) bool {
+	for _, sub := range e {
+		if sub.Eval(doc) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e Not) Eval(doc *fastjson.Value) bool {
+	return !e.Expr.Eval(doc)
+}
+
+func (e Exists) Eval(doc *fastjson.Value) bool {
+	return Field(doc, e.Path) != nil
+}
+
+func (e Compare) Eval(doc *fastjson.Value) bool {
+	field := Field(doc, e.Path)
+	if field == nil {
+		return false
+	}
+
+	c, ok := compare(field, e.Value)
+	switch e.Op {
+	case "=":
+		return ok && c == 0
+	case "!=":
+		return !ok || c != 0
+	}
+
+	// ordering needs two numbers or two strings
+	if !ok || field.Type() == fastjson.TypeObject || field.Type() == fastjson.TypeArray ||
+		field.Type() == fastjson.TypeNull || field.Type() == fastjson.TypeTrue || field.Type() == fastjson.TypeFalse {
+		return false
+	}
+	switch e.Op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+func (e In) Eval(doc *fastjson.Value) bool {
+	field := Field(doc, e.Path)
+	if field == nil {
+		return false
+	}
+	for _, val := range e.Values {
+		if c, ok := compare(field, val); ok && c == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Conjuncts returns the expressions which must all match for e to match, so a
+// caller can look for one it can answer from an index.
+func Conjuncts(e Expr) []Expr {
+	if and, ok := e.(And); ok {
+		var all []Expr
+		for _, sub := range and {
+			all = append(all, Conjuncts(sub)...)
+		}
+		return all
+	}
+	return []Expr{e}
+}
+
+// Field returns the value at the dotted path in the document.
+func Field(doc *fastjson.Value, path string) *fastjson.Value {
+	return doc.Get(strings.Split(path, ".")...)
+}
+
+// compare returns -1, 0 or 1 comparing a with b, and false if they are of
+// types which can't be compared.
+func compare(a, b *fastjson.Value) (int, bool) {
+	switch {
+	case a.Type() == fastjson.TypeNumber && b.Type() == fastjson.TypeNumber:
+		x, y := a.GetFloat64(), b.GetFloat64()
+		if x < y {
+			return -1, true
+		}
+		if x > y {
+			return 1, true
+		}
+		return 0, true
+	case a.Type() == fastjson.TypeString && b.Type() == fastjson.TypeString:
+		return strings.Compare(string(a.GetStringBytes()), string(b.GetStringBytes())), true
+	case a.Type() == b.Type() && (a.Type() == fastjson.TypeNull || a.Type() == fastjson.TypeTrue || a.Type() == fastjson.TypeFalse):
+		return 0, true
+	case isBool(a) && isBool(b):
+		// true and false are different types to fastjson
+		return 1, true
+	}
+	return 0, false
+}
+
+func isBool(val *fastjson.Value) bool {
+	return val.Type() == fastjson.TypeTrue || val.Type() == fastjson.TypeFalse
+}
+
+// Parse parses the expression in src.
+func Parse(src string) (Expr, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected '%s'", p.tokens[p.pos].text)
+	}
+	return e, nil
+}
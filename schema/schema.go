@@ -0,0 +1,361 @@
+// Package schema validates documents against a JSON Schema.
+//
+// Only the commonly used validation keywords are supported: type, enum, const,
+// properties, required, additionalProperties, items, minItems, maxItems,
+// minimum, maximum, exclusiveMinimum, exclusiveMaximum, minLength, maxLength,
+// pattern, allOf, anyOf, oneOf and not. Any other keywords are ignored.
+package schema
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/valyala/fastjson"
+)
+
+// Schema is a compiled JSON Schema.
+type Schema struct {
+	mu  sync.Mutex // fastjson values aren't safe for concurrent use
+	src string
+	val *fastjson.Value
+	re  map[string]*regexp.Regexp
+}
+
+// Compile parses the JSON Schema in src.
+func Compile(src string) (*Schema, error) {
+	var p fastjson.Parser
+	val, err := p.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	if val.Type() != fastjson.TypeObject && val.Type() != fastjson.TypeTrue && val.Type() != fastjson.TypeFalse {
+		return nil, fmt.Errorf("schema must be an object or boolean")
+	}
+
+	s := &Schema{src: src, val: val, re: map[string]*regexp.Regexp{}}
+	err = s.compile(val)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// String returns the source of the schema.
+func (s *Schema) String() string {
+	return s.src
+}
+
+// Validate returns an error describing the first violation found in doc.
+func (s *Schema) Validate(doc *fastjson.Value) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.validate(s.val, doc, "")
+}
+
+// compile checks any sub-schemas and compiles the patterns up front.
+func (s *Schema) compile(val *fastjson.Value) error {
+	if val.Type() != fastjson.TypeObject {
+		return nil
+	}
+
+	if pattern := val.Get("pattern"); pattern != nil {
+		re, err := regexp.Compile(string(pattern.GetStringBytes()))
+		if err != nil {
+			return fmt.Errorf("invalid pattern: %s", err)
+		}
+		s.re[re.String()] = re
+	}
+
+	var err error
+	visit := func(sub *fastjson.Value) {
+		if err == nil {
+			err = s.compile(sub)
+		}
+	}
+	if props := val.GetObject("properties"); props != nil {
+		props.Visit(func(k []byte, sub *fastjson.Value) { visit(sub) })
+	}
+	for _, name := range []string{"additionalProperties", "items", "not"} {
+		if sub := val.Get(name); sub != nil {
+			visit(sub)
+		}
+	}
+	for _, name := range []string{"allOf", "anyOf", "oneOf"} {
+		for _, sub := range val.GetArray(name) {
+			visit(sub)
+		}
+	}
+	return err
+}
+
+func (s *Schema) validate(schema, doc *fastjson.Value, path string) error {
+	switch schema.Type() {
+	case fastjson.TypeTrue:
+		return nil
+	case fastjson.TypeFalse:
+		return fmt.Errorf("%s: not allowed", where(path))
+	case fastjson.TypeObject:
+		// carry on
+	default:
+		return nil
+	}
+
+	if t := schema.Get("type"); t != nil {
+		ok := false
+		if t.Type() == fastjson.TypeArray {
+			for _, name := range t.GetArray() {
+				ok = ok || isType(doc, string(name.GetStringBytes()))
+			}
+		} else {
+			ok = isType(doc, string(t.GetStringBytes()))
+		}
+		if !ok {
+			return fmt.Errorf("%s: expected type %s", where(path), t)
+		}
+	}
+
+	if enum := schema.Get("enum"); enum != nil {
+		ok := false
+		for _, item := range enum.GetArray() {
+			ok = ok || equal(item, doc)
+		}
+		if !ok {
+			return fmt.Errorf("%s: must be one of %s", where(path), enum)
+		}
+	}
+
+	if c := schema.Get("const"); c != nil && !equal(c, doc) {
+		return fmt.Errorf("%s: must be %s", where(path), c)
+	}
+
+	switch doc.Type() {
+	case fastjson.TypeObject:
+		err := s.validateObject(schema, doc, path)
+		if err != nil {
+			return err
+		}
+	case fastjson.TypeArray:
+		err := s.validateArray(schema, doc, path)
+		if err != nil {
+			return err
+		}
+	case fastjson.TypeNumber:
+		err := validateNumber(schema, doc, path)
+		if err != nil {
+			return err
+		}
+	case fastjson.TypeString:
+		err := s.validateString(schema, doc, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, sub := range schema.GetArray("allOf") {
+		err := s.validate(sub, doc, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	if anyOf := schema.GetArray("anyOf"); anyOf != nil {
+		ok := false
+		for _, sub := range anyOf {
+			ok = ok || s.validate(sub, doc, path) == nil
+		}
+		if !ok {
+			return fmt.Errorf("%s: does not match any of the schemas in anyOf", where(path))
+		}
+	}
+
+	if oneOf := schema.GetArray("oneOf"); oneOf != nil {
+		count := 0
+		for _, sub := range oneOf {
+			if s.validate(sub, doc, path) == nil {
+				count++
+			}
+		}
+		if count != 1 {
+			return fmt.Errorf("%s: must match exactly one of the schemas in oneOf", where(path))
+		}
+	}
+
+	if not := schema.Get("not"); not != nil && s.validate(not, doc, path) == nil {
+		return fmt.Errorf("%s: must not match the schema in not", where(path))
+	}
+
+	return nil
+}
+
+func (s *Schema) validateObject(schema, doc *fastjson.Value, path string) error {
+	obj := doc.GetObject()
+
+	for _, name := range schema.GetArray("required") {
+		field := string(name.GetStringBytes())
+		if obj.Get(field) == nil {
+			return fmt.Errorf("%s: missing required field '%s'", where(path), field)
+		}
+	}
+
+	props := schema.GetObject("properties")
+	additional := schema.Get("additionalProperties")
+
+	var err error
+	obj.Visit(func(k []byte, val *fastjson.Value) {
+		if err != nil {
+			return
+		}
+		field := string(k)
+		if props != nil && props.Get(field) != nil {
+			sub := props.Get(field)
+			err = s.validate(sub, val, join(path, field))
+			return
+		}
+		if additional != nil {
+			err = s.validate(additional, val, join(path, field))
+		}
+	})
+	return err
+}
+
+func (s *Schema) validateArray(schema, doc *fastjson.Value, path string) error {
+	items := doc.GetArray()
+
+	if min := schema.Get("minItems"); min != nil && len(items) < min.GetInt() {
+		return fmt.Errorf("%s: must have at least %d items", where(path), min.GetInt())
+	}
+	if max := schema.Get("maxItems"); max != nil && len(items) > max.GetInt() {
+		return fmt.Errorf("%s: must have at most %d items", where(path), max.GetInt())
+	}
+
+	if sub := schema.Get("items"); sub != nil {
+		for i, item := range items {
+			err := s.validate(sub, item, join(path, fmt.Sprintf("%d", i)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateNumber(schema, doc *fastjson.Value, path string) error {
+	n := doc.GetFloat64()
+
+	if min := schema.Get("minimum"); min != nil && n < min.GetFloat64() {
+		return fmt.Errorf("%s: must be >= %s", where(path), min)
+	}
+	if max := schema.Get("maximum"); max != nil && n > max.GetFloat64() {
+		return fmt.Errorf("%s: must be <= %s", where(path), max)
+	}
+	if min := schema.Get("exclusiveMinimum"); min != nil && n <= min.GetFloat64() {
+		return fmt.Errorf("%s: must be > %s", where(path), min)
+	}
+	if max := schema.Get("exclusiveMaximum"); max != nil && n >= max.GetFloat64() {
+		return fmt.Errorf("%s: must be < %s", where(path), max)
+	}
+
+	return nil
+}
+
+func (s *Schema) validateString(schema, doc *fastjson.Value, path string) error {
+	str := string(doc.GetStringBytes())
+	length := utf8.RuneCountInString(str)
+
+	if min := schema.Get("minLength"); min != nil && length < min.GetInt() {
+		return fmt.Errorf("%s: must be at least %d characters", where(path), min.GetInt())
+	}
+	if max := schema.Get("maxLength"); max != nil && length > max.GetInt() {
+		return fmt.Errorf("%s: must be at most %d characters", where(path), max.GetInt())
+	}
+	if pattern := schema.Get("pattern"); pattern != nil {
+		re := s.re[string(pattern.GetStringBytes())]
+		if re != nil && !re.MatchString(str) {
+			return fmt.Errorf("%s: must match pattern %s", where(path), pattern)
+		}
+	}
+
+	return nil
+}
+
+// isType reports whether val is of the JSON Schema type name.
+func isType(val *fastjson.Value, name string) bool {
+	switch name {
+	case "object":
+		return val.Type() == fastjson.TypeObject
+	case "array":
+		return val.Type() == fastjson.TypeArray
+	case "string":
+		return val.Type() == fastjson.TypeString
+	case "number":
+		return val.Type() == fastjson.TypeNumber
+	case "integer":
+		if val.Type() != fastjson.TypeNumber {
+			return false
+		}
+		n := val.GetFloat64()
+		return n == float64(int64(n))
+	case "boolean":
+		return val.Type() == fastjson.TypeTrue || val.Type() == fastjson.TypeFalse
+	case "null":
+		return val.Type() == fastjson.TypeNull
+	}
+	return false
+}
+
+// equal compares two values structurally.
+func equal(a, b *fastjson.Value) bool {
+	if a.Type() != b.Type() {
+		return false
+	}
+
+	switch a.Type() {
+	case fastjson.TypeNumber:
+		return a.GetFloat64() == b.GetFloat64()
+	case fastjson.TypeString:
+		return string(a.GetStringBytes()) == string(b.GetStringBytes())
+	case fastjson.TypeArray:
+		as, bs := a.GetArray(), b.GetArray()
+		if len(as) != len(bs) {
+			return false
+		}
+		for i := range as {
+			if !equal(as[i], bs[i]) {
+				return false
+			}
+		}
+		return true
+	case fastjson.TypeObject:
+		ao, bo := a.GetObject(), b.GetObject()
+		if ao.Len() != bo.Len() {
+			return false
+		}
+		same := true
+		ao.Visit(func(k []byte, v *fastjson.Value) {
+			other := bo.Get(string(k))
+			same = same && other != nil && equal(v, other)
+		})
+		return same
+	}
+
+	// null, true and false only need their types to match
+	return true
+}
+
+func join(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+func where(path string) string {
+	if path == "" {
+		return "document"
+	}
+	return "'" + strings.TrimPrefix(path, ".") + "'"
+}
@@ -0,0 +1,132 @@
+package schema_test
+
+import (
+	"testing"
+
+	"github.com/modb-dev/modb/schema"
+	"github.com/valyala/fastjson"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		doc    string
+		valid  bool
+	}{
+		{"true schema", `true`, `{"a":1}`, true},
+		{"false schema", `false`, `{}`, false},
+		{"no keywords", `{}`, `[1,"x"]`, true},
+		{"unknown keyword", `{"format":"email"}`, `"x"`, true},
+
+		{"type object", `{"type":"object"}`, `{}`, true},
+		{"type object given array", `{"type":"object"}`, `[]`, false},
+		{"type string", `{"type":"string"}`, `"x"`, true},
+		{"type string given number", `{"type":"string"}`, `1`, false},
+		{"type number", `{"type":"number"}`, `1.5`, true},
+		{"type integer", `{"type":"integer"}`, `2`, true},
+		{"type integer given fraction", `{"type":"integer"}`, `2.5`, false},
+		{"type boolean", `{"type":"boolean"}`, `false`, true},
+		{"type boolean given null", `{"type":"boolean"}`, `null`, false},
+		{"type null", `{"type":"null"}`, `null`, true},
+		{"type array", `{"type":"array"}`, `[]`, true},
+		{"type list", `{"type":["string","null"]}`, `null`, true},
+		{"type list mismatch", `{"type":["string","null"]}`, `1`, false},
+
+		{"required present", `{"required":["a","b"]}`, `{"a":1,"b":null}`, true},
+		{"required missing", `{"required":["a","b"]}`, `{"a":1}`, false},
+		{"required on non-object", `{"required":["a"]}`, `"x"`, true},
+
+		{"properties match", `{"properties":{"a":{"type":"number"}}}`, `{"a":1,"b":"x"}`, true},
+		{"properties mismatch", `{"properties":{"a":{"type":"number"}}}`, `{"a":"1"}`, false},
+		{"properties absent", `{"properties":{"a":{"type":"number"}}}`, `{}`, true},
+		{"nested properties", `{"properties":{"a":{"properties":{"b":{"type":"string"}}}}}`, `{"a":{"b":1}}`, false},
+
+		{"additionalProperties false", `{"properties":{"a":{}},"additionalProperties":false}`, `{"a":1,"b":2}`, false},
+		{"additionalProperties false, none extra", `{"properties":{"a":{}},"additionalProperties":false}`, `{"a":1}`, true},
+		{"additionalProperties schema", `{"additionalProperties":{"type":"number"}}`, `{"a":1,"b":2}`, true},
+		{"additionalProperties schema mismatch", `{"additionalProperties":{"type":"number"}}`, `{"a":1,"b":"2"}`, false},
+
+		{"enum match", `{"enum":["a",1,null,{"x":[1]}]}`, `{"x":[1]}`, true},
+		{"enum number", `{"enum":["a",1]}`, `1.0`, true},
+		{"enum mismatch", `{"enum":["a",1]}`, `"b"`, false},
+		{"enum object mismatch", `{"enum":[{"x":1}]}`, `{"x":1,"y":2}`, false},
+		{"const", `{"const":"a"}`, `"a"`, true},
+		{"const mismatch", `{"const":"a"}`, `"b"`, false},
+
+		{"minimum", `{"minimum":5}`, `5`, true},
+		{"below minimum", `{"minimum":5}`, `4.9`, false},
+		{"maximum", `{"maximum":5}`, `5`, true},
+		{"above maximum", `{"maximum":5}`, `5.1`, false},
+		{"exclusiveMinimum", `{"exclusiveMinimum":5}`, `5`, false},
+		{"exclusiveMaximum", `{"exclusiveMaximum":5}`, `4`, true},
+		{"minimum on a string", `{"minimum":5}`, `"1"`, true},
+
+		{"minLength", `{"minLength":2}`, `"ab"`, true},
+		{"below minLength", `{"minLength":2}`, `"a"`, false},
+		{"maxLength", `{"maxLength":2}`, `"ab"`, true},
+		{"above maxLength", `{"maxLength":2}`, `"abc"`, false},
+		{"maxLength counts characters", `{"maxLength":2}`, `"éé"`, true},
+
+		{"pattern", `{"pattern":"^[a-z]+@"}`, `"andy@example.com"`, true},
+		{"pattern mismatch", `{"pattern":"^[a-z]+@"}`, `"Andy@example.com"`, false},
+		{"pattern is unanchored", `{"pattern":"b"}`, `"abc"`, true},
+
+		{"items", `{"items":{"type":"number"}}`, `[1,2,3]`, true},
+		{"items mismatch", `{"items":{"type":"number"}}`, `[1,"2"]`, false},
+		{"minItems", `{"minItems":2}`, `[1]`, false},
+		{"maxItems", `{"maxItems":2}`, `[1,2]`, true},
+		{"above maxItems", `{"maxItems":2}`, `[1,2,3]`, false},
+
+		{"allOf", `{"allOf":[{"minimum":1},{"maximum":3}]}`, `2`, true},
+		{"allOf mismatch", `{"allOf":[{"minimum":1},{"maximum":3}]}`, `4`, false},
+		{"anyOf", `{"anyOf":[{"type":"string"},{"type":"number"}]}`, `1`, true},
+		{"anyOf mismatch", `{"anyOf":[{"type":"string"},{"type":"number"}]}`, `null`, false},
+		{"oneOf", `{"oneOf":[{"minimum":1},{"minimum":3}]}`, `2`, true},
+		{"oneOf matching both", `{"oneOf":[{"minimum":1},{"minimum":3}]}`, `4`, false},
+		{"not", `{"not":{"type":"string"}}`, `1`, true},
+		{"not mismatch", `{"not":{"type":"string"}}`, `"x"`, false},
+	}
+
+	for _, test := range tests {
+		s, err := schema.Compile(test.schema)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		err = s.Validate(fastjson.MustParse(test.doc))
+		if test.valid && err != nil {
+			t.Errorf("%s: %s gave %s", test.name, test.doc, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: %s gave no error", test.name, test.doc)
+		}
+	}
+}
+
+func TestValidateError(t *testing.T) {
+	s, err := schema.Compile(`{"properties":{"a":{"properties":{"b":{"type":"string"}}}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Validate(fastjson.MustParse(`{"a":{"b":1}}`))
+	if err == nil || err.Error() != `'a.b': expected type "string"` {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, src := range []string{
+		`{bad`,
+		`"string"`,
+		`1`,
+		`{"pattern":"("}`,
+		`{"properties":{"a":{"pattern":"["}}}`,
+		`{"items":{"pattern":"("}}`,
+		`{"anyOf":[{"pattern":"("}]}`,
+	} {
+		if _, err := schema.Compile(src); err == nil {
+			t.Errorf("%s compiled", src)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package badger
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"strings"
 
@@ -13,8 +14,21 @@ import (
 var separator = ":"
 var logPrefix = "log" + separator
 var dataPrefix = "data" + separator
+var schemaPrefix = "schema" + separator
+var indexPrefix = "index" + separator
+var entryPrefix = "entry" + separator
+var viewPrefix = "view" + separator
+var quarantinePrefix = "quarantine" + separator
+var endSeparator = "\xff"
 
-type badgerStore struct{ db *badger.DB }
+// backupHeader starts every backup, so that Restore can tell one from anything
+// else.
+const backupHeader = "modb badger backup\n"
+
+type badgerStore struct {
+	db *badger.DB
+	store.Listeners
+}
 
 func Open(dirname string) (store.Storage, error) {
 	var err error
@@ -29,15 +43,16 @@ func Open(dirname string) (store.Storage, error) {
 		log.Fatal(err)
 	}
 
-	return &badgerStore{db}, nil
+	return &badgerStore{db: db}, nil
 }
 
 // op
 func (s *badgerStore) op(key, op, json string) error {
-	id := key + ":" + sid.IdBase64()
+	change := store.Change{Key: key, Id: sid.IdBase64(), Op: op, Diff: json}
+	id := key + ":" + change.Id
 	val := op + ":" + json
 
-	return s.db.Update(func(txn *badger.Txn) error {
+	err := s.db.Update(func(txn *badger.Txn) error {
 		err := txn.Set([]byte(logPrefix+id), []byte(val))
 		if err != nil {
 			return fmt.Errorf("put log bucket: %s", err)
@@ -45,6 +60,12 @@ func (s *badgerStore) op(key, op, json string) error {
 
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	s.Notify(change)
+	return nil
 }
 
 // Puts the JSON to the key provided (an overwrite).
@@ -69,28 +90,66 @@ func (s *badgerStore) Del(key, json string) error {
 	return s.op(key, "del", json)
 }
 
+// Max sets fields to the largest value ever written to them.
+func (s *badgerStore) Max(key, json string) error {
+	return s.op(key, "max", json)
+}
+
+// Min sets fields to the smallest value ever written to them.
+func (s *badgerStore) Min(key, json string) error {
+	return s.op(key, "min", json)
+}
+
+// MvSet writes to a multi-value register, superseding only those siblings
+// which were seen by the writer.
+func (s *badgerStore) MvSet(key, json string) error {
+	return s.op(key, "mvset", json)
+}
+
+// Resolve collapses the siblings of a multi-value register into one value.
+func (s *badgerStore) Resolve(key, json string) error {
+	return s.op(key, "resolve", json)
+}
+
+// TextIns inserts characters into a text field after a given position.
+func (s *badgerStore) TextIns(key, json string) error {
+	return s.op(key, "textins", json)
+}
+
+// TextDel deletes characters from a text field.
+func (s *badgerStore) TextDel(key, json string) error {
+	return s.op(key, "textdel", json)
+}
+
+// Expire sets the deadline after which the key is gone.
+func (s *badgerStore) Expire(key, json string) error {
+	return s.op(key, "expire", json)
+}
+
+// IterateChanges calls fn with each of the key's changes in id order. A log
+// entry too malformed to parse is skipped, and left for verify to report.
 func (s *badgerStore) IterateChanges(key string, fn func(change store.Change)) error {
 	return s.db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchSize = 100
-		prefix := []byte(logPrefix)
+		prefix := []byte(logPrefix + key + separator)
 		it := txn.NewIterator(opts)
 		defer it.Close()
-		for it.Rewind(); it.ValidForPrefix(prefix); it.Next() {
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
 			item := it.Item()
-			k := strings.TrimPrefix(string(item.Key()), logPrefix)
+			id := strings.TrimPrefix(string(item.Key()), string(prefix))
+			if strings.Contains(id, separator) {
+				// belongs to a longer key which shares this prefix
+				continue
+			}
 			v, err := item.Value()
 			if err != nil {
 				return err
 			}
 
-			id := strings.SplitN(k, separator, 2)[1]
-			opDiff := strings.SplitN(string(v), separator, 2)
-			change := store.Change{
-				Key:  key,
-				Id:   id,
-				Op:   opDiff[0],
-				Diff: opDiff[1],
+			change, err := store.ParseLogEntry(key+separator+id, string(v))
+			if err != nil {
+				continue
 			}
 			fn(change)
 		}
@@ -98,41 +157,466 @@ func (s *badgerStore) IterateChanges(key string, fn func(change store.Change)) e
 	})
 }
 
-func (s *badgerStore) IterateLog(fn func(key, val string)) error {
+// Append writes changes which already have ids, such as those loaded from a
+// dump, skipping any already in the log. It returns how many were written.
+func (s *badgerStore) Append(changes []store.Change) (int, error) {
+	var written []store.Change
+	err := s.db.Update(func(txn *badger.Txn) error {
+		written = nil
+		seen := map[string]bool{}
+		for _, change := range changes {
+			id := logPrefix + change.Key + separator + change.Id
+			if seen[id] {
+				continue
+			}
+			_, err := txn.Get([]byte(id))
+			if err == nil {
+				continue
+			}
+			if err != badger.ErrKeyNotFound {
+				return err
+			}
+			err = txn.Set([]byte(id), []byte(change.Op+separator+change.Diff))
+			if err != nil {
+				return fmt.Errorf("put log bucket: %s", err)
+			}
+			seen[id] = true
+			written = append(written, change)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, change := range written {
+		s.Notify(change)
+	}
+	return len(written), nil
+}
+
+// PutData writes a raw data entry.
+func (s *badgerStore) PutData(key, val string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		err := txn.Set([]byte(dataPrefix+key), []byte(val))
+		if err != nil {
+			return fmt.Errorf("put data: %s", err)
+		}
+
+		return nil
+	})
+}
+
+// PutDataBatch writes the raw data entries in one transaction.
+func (s *badgerStore) PutDataBatch(entries []store.Data) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		for _, entry := range entries {
+			err := txn.Set([]byte(dataPrefix+entry.Key), []byte(entry.Val))
+			if err != nil {
+				return fmt.Errorf("put data: %s", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// Purge removes the key's changes up to and including the op id upto from the
+// log, along with its data, then tells any listeners with a `purge` change so
+// that indexes and views let go of the key. The purge itself isn't written to
+// the log, so the change's id is a fresh one which no op in the log has.
+func (s *badgerStore) Purge(key, upto string) error {
+	err := s.db.Update(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		prefix := []byte(logPrefix + key + separator)
+		it := txn.NewIterator(opts)
+
+		var ids [][]byte
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			id := strings.TrimPrefix(string(it.Item().Key()), string(prefix))
+			if strings.Contains(id, separator) || id > upto {
+				continue
+			}
+			ids = append(ids, it.Item().KeyCopy(nil))
+		}
+		it.Close()
+
+		for _, k := range ids {
+			err := txn.Delete(k)
+			if err != nil {
+				return fmt.Errorf("delete log: %s", err)
+			}
+		}
+
+		err := txn.Delete([]byte(dataPrefix + key))
+		if err != nil {
+			return fmt.Errorf("delete data: %s", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.Notify(store.Change{Key: key, Id: sid.IdBase64(), Op: "purge", Diff: "{}"})
+	return nil
+}
+
+// Quarantine moves a raw log entry (or data entry) out of the way to under the
+// quarantine prefix, keeping its own prefix.
+func (s *badgerStore) Quarantine(log bool, key string) error {
+	from := dataPrefix + key
+	if log {
+		from = logPrefix + key
+	}
+
+	return s.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(from))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+
+		err = txn.Set([]byte(quarantinePrefix+from), val)
+		if err != nil {
+			return fmt.Errorf("put quarantine: %s", err)
+		}
+		err = txn.Delete([]byte(from))
+		if err != nil {
+			return fmt.Errorf("delete: %s", err)
+		}
+
+		return nil
+	})
+}
+
+// IterateKeys calls fn for each distinct key in the log, in key order, starting
+// after the key given (or from the start if it is empty) until fn returns
+// false.
+func (s *badgerStore) IterateKeys(after string, fn func(key string) bool) error {
+	return store.IterateKeysAfter(s.IterateLog, after, fn)
+}
+
+// IterateRange calls fn for each distinct key in the log, in key order, from
+// start (inclusive) to end (exclusive), or in reverse, until fn returns false.
+// An empty end has no upper bound.
+func (s *badgerStore) IterateRange(start, end string, reverse bool, fn func(key string) bool) error {
+	return store.IterateKeyRange(s.IterateLog, start, end, reverse, fn)
+}
+
+// IterateLog calls fn with each raw log entry from start onwards, in the order
+// they are stored, until fn returns false.
+func (s *badgerStore) IterateLog(start string, fn func(key, val string) bool) error {
 	return s.db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchSize = 100
 		prefix := []byte(logPrefix)
 		it := txn.NewIterator(opts)
 		defer it.Close()
-		for it.Rewind(); it.ValidForPrefix(prefix); it.Next() {
+		for it.Seek([]byte(logPrefix + start)); it.ValidForPrefix(prefix); it.Next() {
 			item := it.Item()
 			key := item.Key()
 			val, err := item.Value()
 			if err != nil {
 				return err
 			}
-			fn(strings.TrimPrefix(string(key), logPrefix), string(val))
+			if !fn(strings.TrimPrefix(string(key), logPrefix), string(val)) {
+				break
+			}
 		}
 		return nil
 	})
 }
 
-func (s *badgerStore) IterateData(fn func(key, val string)) error {
+// IterateData calls fn with each raw data entry from start onwards, in the order
+// they are stored, until fn returns false.
+func (s *badgerStore) IterateData(start string, fn func(key, val string) bool) error {
 	return s.db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchSize = 100
 		prefix := []byte(dataPrefix)
 		it := txn.NewIterator(opts)
 		defer it.Close()
-		for it.Rewind(); it.ValidForPrefix(prefix); it.Next() {
+		for it.Seek([]byte(dataPrefix + start)); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			key := item.Key()
+			val, err := item.Value()
+			if err != nil {
+				return err
+			}
+			if !fn(strings.TrimPrefix(string(key), dataPrefix), string(val)) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// Backup writes a consistent copy of the whole datastore to w, whilst writes
+// carry on, as backupHeader followed by badger's own backup format, which
+// Restore loads back in.
+func (s *badgerStore) Backup(w io.Writer) error {
+	_, err := io.WriteString(w, backupHeader)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Backup(w, 0)
+	return err
+}
+
+// Restore creates a new datastore in dirname from a backup made by Backup.
+func Restore(dirname string, r io.Reader) error {
+	// badger's Load trusts what it reads, so make sure it's one of our backups
+	header := make([]byte, len(backupHeader))
+	_, err := io.ReadFull(r, header)
+	if err != nil || string(header) != backupHeader {
+		return fmt.Errorf("not a badger backup")
+	}
+
+	opts := badger.DefaultOptions
+	opts.Dir = dirname
+	opts.ValueDir = dirname
+	db, err := badger.Open(opts)
+	if err != nil {
+		return err
+	}
+
+	err = db.Load(r)
+	closeErr := db.Close()
+	if err != nil {
+		return fmt.Errorf("not a badger backup: %s", err)
+	}
+	return closeErr
+}
+
+// PutSchema stores the JSON Schema for keys starting with prefix.
+func (s *badgerStore) PutSchema(prefix, schema string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		err := txn.Set([]byte(schemaPrefix+prefix), []byte(schema))
+		if err != nil {
+			return fmt.Errorf("put schema: %s", err)
+		}
+
+		return nil
+	})
+}
+
+// DelSchema removes the JSON Schema for prefix.
+func (s *badgerStore) DelSchema(prefix string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		err := txn.Delete([]byte(schemaPrefix + prefix))
+		if err != nil {
+			return fmt.Errorf("delete schema: %s", err)
+		}
+
+		return nil
+	})
+}
+
+func (s *badgerStore) IterateSchemas(fn func(prefix, schema string)) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		prefix := []byte(schemaPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			key := item.Key()
+			val, err := item.Value()
+			if err != nil {
+				return err
+			}
+			fn(strings.TrimPrefix(string(key), schemaPrefix), string(val))
+		}
+		return nil
+	})
+}
+
+// PutIndex stores the definition of an index.
+func (s *badgerStore) PutIndex(name, def string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		err := txn.Set([]byte(indexPrefix+name), []byte(def))
+		if err != nil {
+			return fmt.Errorf("put index: %s", err)
+		}
+
+		return nil
+	})
+}
+
+// DelIndex removes an index's definition and all of its entries.
+func (s *badgerStore) DelIndex(name string) error {
+	// collect the entries first, since a transaction can only hold so many
+	var keys [][]byte
+	prefix := []byte(entryPrefix + name + separator)
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	txn := s.db.NewTransaction(true)
+	defer func() { txn.Discard() }()
+	keys = append(keys, []byte(indexPrefix+name))
+	for _, k := range keys {
+		err := txn.Delete(k)
+		if err == badger.ErrTxnTooBig {
+			err = txn.Commit(nil)
+			if err != nil {
+				return err
+			}
+			txn = s.db.NewTransaction(true)
+			err = txn.Delete(k)
+		}
+		if err != nil {
+			return fmt.Errorf("delete index entry: %s", err)
+		}
+	}
+
+	return txn.Commit(nil)
+}
+
+func (s *badgerStore) IterateIndexes(fn func(name, def string)) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		prefix := []byte(indexPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			key := item.Key()
+			val, err := item.Value()
+			if err != nil {
+				return err
+			}
+			fn(strings.TrimPrefix(string(key), indexPrefix), string(val))
+		}
+		return nil
+	})
+}
+
+// SetIndexEntry indexes the key under an (encoded) value, replacing any value
+// it was indexed under before. An empty value removes the key from the index.
+func (s *badgerStore) SetIndexEntry(name, key, value string) error {
+	// entries are "entry:<name>:v:<value>\x00<key>" for lookups, and
+	// "entry:<name>:k:<key>" to remember which value the key is indexed under
+	prefix := entryPrefix + name + separator
+
+	return s.db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(indexPrefix + name))
+		if err == badger.ErrKeyNotFound {
+			return fmt.Errorf("unknown index '%s'", name)
+		}
+		if err != nil {
+			return err
+		}
+
+		item, err := txn.Get([]byte(prefix + "k:" + key))
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+		if err == nil {
+			old, err := item.Value()
+			if err != nil {
+				return err
+			}
+			err = txn.Delete([]byte(prefix + "v:" + string(old) + "\x00" + key))
+			if err != nil {
+				return fmt.Errorf("delete index entry: %s", err)
+			}
+		}
+
+		if value == "" {
+			return txn.Delete([]byte(prefix + "k:" + key))
+		}
+
+		err = txn.Set([]byte(prefix+"v:"+value+"\x00"+key), []byte{})
+		if err != nil {
+			return fmt.Errorf("put index entry: %s", err)
+		}
+		return txn.Set([]byte(prefix+"k:"+key), []byte(value))
+	})
+}
+
+// IterateIndex calls fn with each (encoded) value and key in the index from
+// start (inclusive) to end (exclusive), until fn returns false. An empty end
+// has no upper bound.
+func (s *badgerStore) IterateIndex(name, start, end string, fn func(value, key string) bool) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		prefix := entryPrefix + name + separator + "v:"
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek([]byte(prefix + start)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+			entry := strings.TrimPrefix(string(it.Item().Key()), prefix)
+			if end != "" && entry >= end {
+				break
+			}
+			value := strings.SplitN(entry, "\x00", 2)
+			if len(value) == 2 && !fn(value[0], value[1]) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// PutView stores the definition of a view.
+func (s *badgerStore) PutView(name, def string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		err := txn.Set([]byte(viewPrefix+name), []byte(def))
+		if err != nil {
+			return fmt.Errorf("put view: %s", err)
+		}
+
+		return nil
+	})
+}
+
+// DelView removes the definition of a view.
+func (s *badgerStore) DelView(name string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		err := txn.Delete([]byte(viewPrefix + name))
+		if err != nil {
+			return fmt.Errorf("delete view: %s", err)
+		}
+
+		return nil
+	})
+}
+
+func (s *badgerStore) IterateViews(fn func(name, def string)) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		prefix := []byte(viewPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
 			item := it.Item()
 			key := item.Key()
 			val, err := item.Value()
 			if err != nil {
 				return err
 			}
-			fn(strings.TrimPrefix(string(key), dataPrefix), string(val))
+			fn(strings.TrimPrefix(string(key), viewPrefix), string(val))
 		}
 		return nil
 	})
@@ -2,6 +2,8 @@ package bbolt
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"strings"
 	"time"
 
@@ -13,8 +15,16 @@ import (
 var separator = ":"
 var logBucketName = []byte("log")
 var dataBucketName = []byte("data")
+var schemaBucketName = []byte("schema")
+var indexBucketName = []byte("index")
+var entryBucketName = []byte("entry")
+var viewBucketName = []byte("view")
+var quarantineBucketName = []byte("quarantine")
 
-type bboltStore struct{ db *bbolt.DB }
+type bboltStore struct {
+	db *bbolt.DB
+	store.Listeners
+}
 
 func Open(filename string) (store.Storage, error) {
 	var err error
@@ -38,21 +48,50 @@ func Open(filename string) (store.Storage, error) {
 			return fmt.Errorf("create data bucket: %s", err)
 		}
 
+		// schema
+		_, err = tx.CreateBucketIfNotExists(schemaBucketName)
+		if err != nil {
+			return fmt.Errorf("create schema bucket: %s", err)
+		}
+
+		// index definitions, and their entries in a bucket per index
+		_, err = tx.CreateBucketIfNotExists(indexBucketName)
+		if err != nil {
+			return fmt.Errorf("create index bucket: %s", err)
+		}
+		_, err = tx.CreateBucketIfNotExists(entryBucketName)
+		if err != nil {
+			return fmt.Errorf("create entry bucket: %s", err)
+		}
+
+		// view definitions
+		_, err = tx.CreateBucketIfNotExists(viewBucketName)
+		if err != nil {
+			return fmt.Errorf("create view bucket: %s", err)
+		}
+
+		// entries set aside by `modb verify --repair`
+		_, err = tx.CreateBucketIfNotExists(quarantineBucketName)
+		if err != nil {
+			return fmt.Errorf("create quarantine bucket: %s", err)
+		}
+
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	return &bboltStore{db}, nil
+	return &bboltStore{db: db}, nil
 }
 
 // Generic 'op'.
 func (s *bboltStore) op(key, op, json string) error {
-	id := key + separator + sid.IdBase64()
+	change := store.Change{Key: key, Id: sid.IdBase64(), Op: op, Diff: json}
+	id := key + separator + change.Id
 	val := op + separator + json
 
-	return s.db.Update(func(tx *bbolt.Tx) error {
+	err := s.db.Update(func(tx *bbolt.Tx) error {
 		kb := tx.Bucket(logBucketName)
 		err := kb.Put([]byte(id), []byte(val))
 		if err != nil {
@@ -61,6 +100,12 @@ func (s *bboltStore) op(key, op, json string) error {
 
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	s.Notify(change)
+	return nil
 }
 
 // Puts the JSON to the key provided (an overwrite).
@@ -85,42 +130,442 @@ func (s *bboltStore) Del(key, json string) error {
 	return s.op(key, "del", json)
 }
 
+// Max sets fields to the largest value ever written to them.
+func (s *bboltStore) Max(key, json string) error {
+	return s.op(key, "max", json)
+}
+
+// Min sets fields to the smallest value ever written to them.
+func (s *bboltStore) Min(key, json string) error {
+	return s.op(key, "min", json)
+}
+
+// MvSet writes to a multi-value register, superseding only those siblings
+// which were seen by the writer.
+func (s *bboltStore) MvSet(key, json string) error {
+	return s.op(key, "mvset", json)
+}
+
+// Resolve collapses the siblings of a multi-value register into one value.
+func (s *bboltStore) Resolve(key, json string) error {
+	return s.op(key, "resolve", json)
+}
+
+// TextIns inserts characters into a text field after a given position.
+func (s *bboltStore) TextIns(key, json string) error {
+	return s.op(key, "textins", json)
+}
+
+// TextDel deletes characters from a text field.
+func (s *bboltStore) TextDel(key, json string) error {
+	return s.op(key, "textdel", json)
+}
+
+// Expire sets the deadline after which the key is gone.
+func (s *bboltStore) Expire(key, json string) error {
+	return s.op(key, "expire", json)
+}
+
+// IterateChanges calls fn with each of the key's changes in id order. A log
+// entry too malformed to parse is skipped, and left for verify to report.
 func (s *bboltStore) IterateChanges(key string, fn func(change store.Change)) error {
+	prefix := key + separator
+
 	return s.db.View(func(tx *bbolt.Tx) error {
 		kb := tx.Bucket(logBucketName)
 		c := kb.Cursor()
-		for k, v := c.Seek([]byte(key)); k != nil; k, v = c.Next() {
-			if strings.HasPrefix(string(k), key+separator) {
-				id := strings.SplitN(string(k), separator, 2)[1]
-				opDiff := strings.SplitN(string(v), separator, 2)
-				change := store.Change{
-					Key:  key,
-					Id:   id,
-					Op:   opDiff[0],
-					Diff: opDiff[1],
-				}
-				fn(change)
+		for k, v := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, v = c.Next() {
+			id := strings.TrimPrefix(string(k), prefix)
+			if strings.Contains(id, separator) {
+				// belongs to a longer key which shares this prefix
+				continue
+			}
+			change, err := store.ParseLogEntry(key+separator+id, string(v))
+			if err != nil {
+				continue
 			}
+			fn(change)
 		}
 		return nil
 	})
 }
 
-func (s *bboltStore) IterateLog(fn func(key, val string)) error {
+// Append writes changes which already have ids, such as those loaded from a
+// dump, skipping any already in the log. It returns how many were written.
+func (s *bboltStore) Append(changes []store.Change) (int, error) {
+	var written []store.Change
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		written = nil
+		kb := tx.Bucket(logBucketName)
+		for _, change := range changes {
+			id := []byte(change.Key + separator + change.Id)
+			if kb.Get(id) != nil {
+				continue
+			}
+			err := kb.Put(id, []byte(change.Op+separator+change.Diff))
+			if err != nil {
+				return fmt.Errorf("put key bucket: %s", err)
+			}
+			written = append(written, change)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, change := range written {
+		s.Notify(change)
+	}
+	return len(written), nil
+}
+
+// PutData writes a raw data entry.
+func (s *bboltStore) PutData(key, val string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		db := tx.Bucket(dataBucketName)
+		err := db.Put([]byte(key), []byte(val))
+		if err != nil {
+			return fmt.Errorf("put data bucket: %s", err)
+		}
+
+		return nil
+	})
+}
+
+// PutDataBatch writes the raw data entries in one transaction.
+func (s *bboltStore) PutDataBatch(entries []store.Data) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		db := tx.Bucket(dataBucketName)
+		for _, entry := range entries {
+			err := db.Put([]byte(entry.Key), []byte(entry.Val))
+			if err != nil {
+				return fmt.Errorf("put data bucket: %s", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// Purge removes the key's changes up to and including the op id upto from the
+// log, along with its data, then tells any listeners with a `purge` change so
+// that indexes and views let go of the key. The purge itself isn't written to
+// the log, so the change's id is a fresh one which no op in the log has.
+func (s *bboltStore) Purge(key, upto string) error {
+	prefix := key + separator
+
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		kb := tx.Bucket(logBucketName)
+
+		// collect first, since deleting moves the cursor on
+		var ids [][]byte
+		c := kb.Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, _ = c.Next() {
+			id := strings.TrimPrefix(string(k), prefix)
+			if strings.Contains(id, separator) || id > upto {
+				continue
+			}
+			ids = append(ids, append([]byte{}, k...))
+		}
+		for _, k := range ids {
+			err := kb.Delete(k)
+			if err != nil {
+				return fmt.Errorf("delete key bucket: %s", err)
+			}
+		}
+
+		err := tx.Bucket(dataBucketName).Delete([]byte(key))
+		if err != nil {
+			return fmt.Errorf("delete data bucket: %s", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.Notify(store.Change{Key: key, Id: sid.IdBase64(), Op: "purge", Diff: "{}"})
+	return nil
+}
+
+// Quarantine moves a raw log entry (or data entry) out of the way into the
+// quarantine bucket, keyed by "log:" (or "data:") and its raw key.
+func (s *bboltStore) Quarantine(log bool, key string) error {
+	from, section := dataBucketName, "data"
+	if log {
+		from, section = logBucketName, "log"
+	}
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(from)
+		val := b.Get([]byte(key))
+		if val == nil {
+			return nil
+		}
+		err := tx.Bucket(quarantineBucketName).Put([]byte(section+separator+key), val)
+		if err != nil {
+			return fmt.Errorf("put quarantine bucket: %s", err)
+		}
+		err = b.Delete([]byte(key))
+		if err != nil {
+			return fmt.Errorf("delete %s bucket: %s", section, err)
+		}
+
+		return nil
+	})
+}
+
+// IterateKeys calls fn for each distinct key in the log, in key order, starting
+// after the key given (or from the start if it is empty) until fn returns
+// false.
+func (s *bboltStore) IterateKeys(after string, fn func(key string) bool) error {
+	return store.IterateKeysAfter(s.IterateLog, after, fn)
+}
+
+// IterateRange calls fn for each distinct key in the log, in key order, from
+// start (inclusive) to end (exclusive), or in reverse, until fn returns false.
+// An empty end has no upper bound.
+func (s *bboltStore) IterateRange(start, end string, reverse bool, fn func(key string) bool) error {
+	return store.IterateKeyRange(s.IterateLog, start, end, reverse, fn)
+}
+
+// IterateLog calls fn with each raw log entry from start onwards, in the order
+// they are stored, until fn returns false.
+func (s *bboltStore) IterateLog(start string, fn func(key, val string) bool) error {
 	return s.db.View(func(tx *bbolt.Tx) error {
 		kb := tx.Bucket(logBucketName)
 		c := kb.Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			fn(string(k), string(v))
+		for k, v := c.Seek([]byte(start)); k != nil; k, v = c.Next() {
+			if !fn(string(k), string(v)) {
+				break
+			}
 		}
 		return nil
 	})
 }
 
-func (s *bboltStore) IterateData(fn func(key, val string)) error {
+// IterateData calls fn with each raw data entry from start onwards, in the order
+// they are stored, until fn returns false.
+func (s *bboltStore) IterateData(start string, fn func(key, val string) bool) error {
 	return s.db.View(func(tx *bbolt.Tx) error {
 		kb := tx.Bucket(dataBucketName)
 		c := kb.Cursor()
+		for k, v := c.Seek([]byte(start)); k != nil; k, v = c.Next() {
+			if !fn(string(k), string(v)) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// Backup writes a consistent copy of the whole datastore to w, whilst writes
+// carry on, as a bbolt file which Restore turns back into a datastore.
+func (s *bboltStore) Backup(w io.Writer) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+// Restore creates a new datastore at filename from a backup made by Backup.
+func Restore(filename string, r io.Reader) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename)
+		return err
+	}
+
+	// make sure it's a bbolt file before calling it a datastore
+	db, err := bbolt.Open(filename, 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		os.Remove(filename)
+		return fmt.Errorf("not a bbolt backup: %s", err)
+	}
+	return db.Close()
+}
+
+// PutSchema stores the JSON Schema for keys starting with prefix.
+func (s *bboltStore) PutSchema(prefix, schema string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		sb := tx.Bucket(schemaBucketName)
+		err := sb.Put([]byte(prefix), []byte(schema))
+		if err != nil {
+			return fmt.Errorf("put schema bucket: %s", err)
+		}
+
+		return nil
+	})
+}
+
+// DelSchema removes the JSON Schema for prefix.
+func (s *bboltStore) DelSchema(prefix string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		sb := tx.Bucket(schemaBucketName)
+		err := sb.Delete([]byte(prefix))
+		if err != nil {
+			return fmt.Errorf("delete schema bucket: %s", err)
+		}
+
+		return nil
+	})
+}
+
+func (s *bboltStore) IterateSchemas(fn func(prefix, schema string)) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		sb := tx.Bucket(schemaBucketName)
+		c := sb.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			fn(string(k), string(v))
+		}
+		return nil
+	})
+}
+
+// PutIndex stores the definition of an index.
+func (s *bboltStore) PutIndex(name, def string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		ib := tx.Bucket(indexBucketName)
+		err := ib.Put([]byte(name), []byte(def))
+		if err != nil {
+			return fmt.Errorf("put index bucket: %s", err)
+		}
+
+		_, err = tx.Bucket(entryBucketName).CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return fmt.Errorf("create entry bucket: %s", err)
+		}
+
+		return nil
+	})
+}
+
+// DelIndex removes an index's definition and all of its entries.
+func (s *bboltStore) DelIndex(name string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		ib := tx.Bucket(indexBucketName)
+		err := ib.Delete([]byte(name))
+		if err != nil {
+			return fmt.Errorf("delete index bucket: %s", err)
+		}
+
+		err = tx.Bucket(entryBucketName).DeleteBucket([]byte(name))
+		if err != nil && err != bbolt.ErrBucketNotFound {
+			return fmt.Errorf("delete entry bucket: %s", err)
+		}
+
+		return nil
+	})
+}
+
+func (s *bboltStore) IterateIndexes(fn func(name, def string)) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		ib := tx.Bucket(indexBucketName)
+		c := ib.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			fn(string(k), string(v))
+		}
+		return nil
+	})
+}
+
+// SetIndexEntry indexes the key under an (encoded) value, replacing any value
+// it was indexed under before. An empty value removes the key from the index.
+func (s *bboltStore) SetIndexEntry(name, key, value string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		eb := tx.Bucket(entryBucketName).Bucket([]byte(name))
+		if eb == nil {
+			return fmt.Errorf("unknown index '%s'", name)
+		}
+
+		// entries are "v:<value>\x00<key>" for lookups, and "k:<key>" to
+		// remember which value the key is indexed under
+		old := eb.Get([]byte("k:" + key))
+		if old != nil {
+			err := eb.Delete([]byte("v:" + string(old) + "\x00" + key))
+			if err != nil {
+				return fmt.Errorf("delete entry bucket: %s", err)
+			}
+		}
+
+		if value == "" {
+			return eb.Delete([]byte("k:" + key))
+		}
+
+		err := eb.Put([]byte("v:"+value+"\x00"+key), []byte{})
+		if err != nil {
+			return fmt.Errorf("put entry bucket: %s", err)
+		}
+		return eb.Put([]byte("k:"+key), []byte(value))
+	})
+}
+
+// IterateIndex calls fn with each (encoded) value and key in the index from
+// start (inclusive) to end (exclusive), until fn returns false. An empty end
+// has no upper bound.
+func (s *bboltStore) IterateIndex(name, start, end string, fn func(value, key string) bool) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		eb := tx.Bucket(entryBucketName).Bucket([]byte(name))
+		if eb == nil {
+			return fmt.Errorf("unknown index '%s'", name)
+		}
+
+		c := eb.Cursor()
+		for k, _ := c.Seek([]byte("v:" + start)); k != nil && strings.HasPrefix(string(k), "v:"); k, _ = c.Next() {
+			entry := strings.TrimPrefix(string(k), "v:")
+			if end != "" && entry >= end {
+				break
+			}
+			value := strings.SplitN(entry, "\x00", 2)
+			if len(value) == 2 && !fn(value[0], value[1]) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// PutView stores the definition of a view.
+func (s *bboltStore) PutView(name, def string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		vb := tx.Bucket(viewBucketName)
+		err := vb.Put([]byte(name), []byte(def))
+		if err != nil {
+			return fmt.Errorf("put view bucket: %s", err)
+		}
+
+		return nil
+	})
+}
+
+// DelView removes the definition of a view.
+func (s *bboltStore) DelView(name string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		vb := tx.Bucket(viewBucketName)
+		err := vb.Delete([]byte(name))
+		if err != nil {
+			return fmt.Errorf("delete view bucket: %s", err)
+		}
+
+		return nil
+	})
+}
+
+func (s *bboltStore) IterateViews(fn func(name, def string)) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		vb := tx.Bucket(viewBucketName)
+		c := vb.Cursor()
 		for k, v := c.First(); k != nil; k, v = c.Next() {
 			fn(string(k), string(v))
 		}
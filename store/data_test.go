@@ -0,0 +1,43 @@
+package store_test
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/modb-dev/modb/store"
+)
+
+func TestPutDataBatch(t *testing.T) {
+	eachStore(t, func(t *testing.T, db store.Storage) {
+		if err := db.PutDataBatch(nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutData("k:0", "old"); err != nil {
+			t.Fatal(err)
+		}
+
+		var entries []store.Data
+		want := map[string]string{}
+		for i := 0; i < 250; i++ {
+			key := "k:" + strconv.Itoa(i)
+			entries = append(entries, store.Data{Key: key, Val: "v" + strconv.Itoa(i)})
+			want[key] = "v" + strconv.Itoa(i)
+		}
+		if err := db.PutDataBatch(entries); err != nil {
+			t.Fatal(err)
+		}
+
+		got := map[string]string{}
+		err := db.IterateData("", func(key, val string) bool {
+			got[key] = val
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %d data entries, want %d", len(got), len(want))
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// idChars are the characters used by sid, in ASCII order so that ids sort by
+// the time they were created.
+const idChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ_abcdefghijklmnopqrstuvwxyz~"
+
+// idLen is the length of each half of an id, "XXXXXXXXXXX-YYYYYYYYYYY", where
+// X is the timestamp in nanoseconds and Y is a random number.
+const idLen = 11
+
+// timeFormats are the timestamps accepted by ParseAt.
+var timeFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// IdAt returns the largest id which could have been created at time t, so
+// every op made at or before t has an id less than or equal to it.
+func IdAt(t time.Time) string {
+	n := t.UnixNano()
+	b := make([]byte, idLen)
+	for i := idLen - 1; i >= 0; i-- {
+		b[i] = idChars[n%64]
+		n = n / 64
+	}
+	return string(b) + "-" + strings.Repeat("~", idLen)
+}
+
+// IdTime returns the time an id was created.
+func IdTime(id string) (time.Time, error) {
+	if len(id) != idLen*2+1 || id[idLen] != '-' {
+		return time.Time{}, fmt.Errorf("invalid id '%s'", id)
+	}
+
+	var n int64
+	for i := 0; i < len(id); i++ {
+		if i == idLen {
+			continue
+		}
+		c := strings.IndexByte(idChars, id[i])
+		if c < 0 {
+			return time.Time{}, fmt.Errorf("invalid id '%s'", id)
+		}
+		if i < idLen {
+			n = n*64 + int64(c)
+		}
+	}
+
+	return time.Unix(0, n).UTC(), nil
+}
+
+// ParseAt turns an op id or a timestamp (taken as UTC if it has no zone) into
+// the id of the last op to include when reading a document as it was then.
+func ParseAt(at string) (string, error) {
+	if _, err := IdTime(at); err == nil {
+		return at, nil
+	}
+
+	for _, format := range timeFormats {
+		t, err := time.Parse(format, at)
+		if err == nil {
+			return IdAt(t), nil
+		}
+	}
+
+	return "", fmt.Errorf("invalid timestamp or op id '%s'", at)
+}
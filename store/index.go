@@ -0,0 +1,56 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+// validIndexName is what an index may be called, keeping the separators used
+// when storing index entries out of its name.
+var validIndexName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ValidIndexName reports whether name can be used for an index.
+func ValidIndexName(name string) bool {
+	return validIndexName.MatchString(name)
+}
+
+// IndexValue encodes a JSON value as a string which sorts in the same order as
+// the values themselves: null, false, true, numbers, then strings. Objects and
+// arrays aren't indexed, so give an empty string.
+func IndexValue(val *fastjson.Value) string {
+	if val == nil {
+		return ""
+	}
+
+	switch val.Type() {
+	case fastjson.TypeNull:
+		return "0"
+	case fastjson.TypeFalse:
+		return "1"
+	case fastjson.TypeTrue:
+		return "2"
+	case fastjson.TypeNumber:
+		// flip the sign bit for positive numbers and every bit for negative
+		// ones, which makes the bits sort like the numbers do
+		bits := math.Float64bits(val.GetFloat64())
+		if bits&(1<<63) == 0 {
+			bits ^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return fmt.Sprintf("3%016x", bits)
+	case fastjson.TypeString:
+		return "4" + string(val.GetStringBytes())
+	}
+
+	return ""
+}
+
+// IndexField returns the value at the dotted path in the document.
+func IndexField(doc *Doc, path string) *fastjson.Value {
+	return doc.Value().Get(strings.Split(path, ".")...)
+}
@@ -1,20 +1,40 @@
 package level
 
 import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"strings"
 
 	"github.com/chilts/sid"
 	"github.com/modb-dev/modb/store"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
+// backupHeader starts every backup, so that Restore can tell one from anything
+// else.
+const backupHeader = "modb level backup\n"
+
+// restoreBatch is how many entries Restore writes at a time.
+const restoreBatch = 1000
+
 var separator = ":"
 var endSeparator = "\xff"
 var logPrefix = "log" + separator
 var dataPrefix = "data" + separator
+var schemaPrefix = "schema" + separator
+var indexPrefix = "index" + separator
+var entryPrefix = "entry" + separator
+var viewPrefix = "view" + separator
+var quarantinePrefix = "quarantine" + separator
 
-type levelStore struct{ db *leveldb.DB }
+type levelStore struct {
+	db *leveldb.DB
+	store.Listeners
+}
 
 func Open(filename string) (store.Storage, error) {
 	var err error
@@ -24,15 +44,22 @@ func Open(filename string) (store.Storage, error) {
 		return nil, err
 	}
 
-	return &levelStore{db}, nil
+	return &levelStore{db: db}, nil
 }
 
 // Generic 'op'.
 func (s *levelStore) op(key, op, json string) error {
-	id := key + ":" + sid.IdBase64()
+	change := store.Change{Key: key, Id: sid.IdBase64(), Op: op, Diff: json}
+	id := key + ":" + change.Id
 	val := op + ":" + json
 
-	return s.db.Put([]byte(logPrefix+id), []byte(val), nil)
+	err := s.db.Put([]byte(logPrefix+id), []byte(val), nil)
+	if err != nil {
+		return err
+	}
+
+	s.Notify(change)
+	return nil
 }
 
 // Puts the JSON to the key provided (an overwrite).
@@ -57,60 +84,476 @@ func (s *levelStore) Del(key, json string) error {
 	return s.op(key, "del", json)
 }
 
+// Max sets fields to the largest value ever written to them.
+func (s *levelStore) Max(key, json string) error {
+	return s.op(key, "max", json)
+}
+
+// Min sets fields to the smallest value ever written to them.
+func (s *levelStore) Min(key, json string) error {
+	return s.op(key, "min", json)
+}
+
+// MvSet writes to a multi-value register, superseding only those siblings
+// which were seen by the writer.
+func (s *levelStore) MvSet(key, json string) error {
+	return s.op(key, "mvset", json)
+}
+
+// Resolve collapses the siblings of a multi-value register into one value.
+func (s *levelStore) Resolve(key, json string) error {
+	return s.op(key, "resolve", json)
+}
+
+// TextIns inserts characters into a text field after a given position.
+func (s *levelStore) TextIns(key, json string) error {
+	return s.op(key, "textins", json)
+}
+
+// TextDel deletes characters from a text field.
+func (s *levelStore) TextDel(key, json string) error {
+	return s.op(key, "textdel", json)
+}
+
+// Expire sets the deadline after which the key is gone.
+func (s *levelStore) Expire(key, json string) error {
+	return s.op(key, "expire", json)
+}
+
+// IterateChanges calls fn with each of the key's changes in id order. A log
+// entry too malformed to parse is skipped, and left for verify to report.
 func (s *levelStore) IterateChanges(key string, fn func(change store.Change)) error {
+	prefix := logPrefix + key + separator
 	r := util.Range{
-		Start: []byte(logPrefix),
-		Limit: []byte(logPrefix + endSeparator),
+		Start: []byte(prefix),
+		Limit: []byte(prefix + endSeparator),
 	}
 
 	iter := s.db.NewIterator(&r, nil)
+	defer iter.Release()
 	for iter.Next() {
-		k := strings.TrimPrefix(string(iter.Key()), logPrefix)
-		v := string(iter.Value())
-		id := strings.SplitN(k, separator, 2)[1]
-		opDiff := strings.SplitN(v, separator, 2)
-		change := store.Change{
-			Key:  key,
-			Id:   id,
-			Op:   opDiff[0],
-			Diff: opDiff[1],
+		id := strings.TrimPrefix(string(iter.Key()), prefix)
+		if strings.Contains(id, separator) {
+			// belongs to a longer key which shares this prefix
+			continue
+		}
+		change, err := store.ParseLogEntry(key+separator+id, string(iter.Value()))
+		if err != nil {
+			continue
 		}
 		fn(change)
 	}
 
+	return iter.Error()
+}
+
+// Append writes changes which already have ids, such as those loaded from a
+// dump, skipping any already in the log. It returns how many were written.
+func (s *levelStore) Append(changes []store.Change) (int, error) {
+	var written []store.Change
+	seen := map[string]bool{}
+	batch := new(leveldb.Batch)
+	for _, change := range changes {
+		id := logPrefix + change.Key + separator + change.Id
+		if seen[id] {
+			continue
+		}
+		exists, err := s.db.Has([]byte(id), nil)
+		if err != nil {
+			return 0, err
+		}
+		if exists {
+			continue
+		}
+		batch.Put([]byte(id), []byte(change.Op+separator+change.Diff))
+		seen[id] = true
+		written = append(written, change)
+	}
+
+	err := s.db.Write(batch, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, change := range written {
+		s.Notify(change)
+	}
+	return len(written), nil
+}
+
+// PutData writes a raw data entry.
+func (s *levelStore) PutData(key, val string) error {
+	return s.db.Put([]byte(dataPrefix+key), []byte(val), nil)
+}
+
+// PutDataBatch writes the raw data entries in one batch.
+func (s *levelStore) PutDataBatch(entries []store.Data) error {
+	batch := new(leveldb.Batch)
+	for _, entry := range entries {
+		batch.Put([]byte(dataPrefix+entry.Key), []byte(entry.Val))
+	}
+	return s.db.Write(batch, nil)
+}
+
+// Purge removes the key's changes up to and including the op id upto from the
+// log, along with its data, then tells any listeners with a `purge` change so
+// that indexes and views let go of the key. The purge itself isn't written to
+// the log, so the change's id is a fresh one which no op in the log has.
+func (s *levelStore) Purge(key, upto string) error {
+	prefix := logPrefix + key + separator
+	r := util.Range{
+		Start: []byte(prefix),
+		Limit: []byte(prefix + endSeparator),
+	}
+
+	batch := new(leveldb.Batch)
+	iter := s.db.NewIterator(&r, nil)
+	for iter.Next() {
+		id := strings.TrimPrefix(string(iter.Key()), prefix)
+		if strings.Contains(id, separator) || id > upto {
+			continue
+		}
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	batch.Delete([]byte(dataPrefix + key))
+
+	err := s.db.Write(batch, nil)
+	if err != nil {
+		return err
+	}
+
+	s.Notify(store.Change{Key: key, Id: sid.IdBase64(), Op: "purge", Diff: "{}"})
 	return nil
 }
 
-func (s *levelStore) IterateLog(fn func(key, val string)) error {
+// Quarantine moves a raw log entry (or data entry) out of the way to under the
+// quarantine prefix, keeping its own prefix.
+func (s *levelStore) Quarantine(log bool, key string) error {
+	from := dataPrefix + key
+	if log {
+		from = logPrefix + key
+	}
+
+	val, err := s.db.Get([]byte(from), nil)
+	if err == leveldb.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Put([]byte(quarantinePrefix+from), val)
+	batch.Delete([]byte(from))
+	return s.db.Write(batch, nil)
+}
+
+// IterateKeys calls fn for each distinct key in the log, in key order, starting
+// after the key given (or from the start if it is empty) until fn returns
+// false.
+func (s *levelStore) IterateKeys(after string, fn func(key string) bool) error {
+	return store.IterateKeysAfter(s.IterateLog, after, fn)
+}
+
+// IterateRange calls fn for each distinct key in the log, in key order, from
+// start (inclusive) to end (exclusive), or in reverse, until fn returns false.
+// An empty end has no upper bound.
+func (s *levelStore) IterateRange(start, end string, reverse bool, fn func(key string) bool) error {
+	return store.IterateKeyRange(s.IterateLog, start, end, reverse, fn)
+}
+
+// IterateLog calls fn with each raw log entry from start onwards, in the order
+// they are stored, until fn returns false.
+func (s *levelStore) IterateLog(start string, fn func(key, val string) bool) error {
 	r := util.Range{
-		Start: []byte(logPrefix),
+		Start: []byte(logPrefix + start),
 		Limit: []byte(logPrefix + endSeparator),
 	}
 
 	iter := s.db.NewIterator(&r, nil)
+	defer iter.Release()
 	for iter.Next() {
 		k := strings.TrimPrefix(string(iter.Key()), logPrefix)
 		v := string(iter.Value())
-		fn(k, v)
+		if !fn(k, v) {
+			break
+		}
 	}
 
-	return nil
+	return iter.Error()
 }
 
-func (s *levelStore) IterateData(fn func(key, val string)) error {
+// IterateData calls fn with each raw data entry from start onwards, in the order
+// they are stored, until fn returns false.
+func (s *levelStore) IterateData(start string, fn func(key, val string) bool) error {
 	r := util.Range{
-		Start: []byte(dataPrefix),
+		Start: []byte(dataPrefix + start),
 		Limit: []byte(dataPrefix + endSeparator),
 	}
 
 	iter := s.db.NewIterator(&r, nil)
+	defer iter.Release()
 	for iter.Next() {
 		k := strings.TrimPrefix(string(iter.Key()), dataPrefix)
 		v := string(iter.Value())
+		if !fn(k, v) {
+			break
+		}
+	}
+
+	return iter.Error()
+}
+
+// Backup writes a consistent copy of the whole datastore to w from a snapshot,
+// whilst writes carry on. LevelDB has no backup format of its own, so after
+// backupHeader each entry is written as its key then its value, both preceded
+// by their length as a uvarint, which Restore reads back in.
+func (s *levelStore) Backup(w io.Writer) error {
+	snap, err := s.db.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(backupHeader)
+	iter := snap.NewIterator(nil, nil)
+	defer iter.Release()
+	buf := make([]byte, binary.MaxVarintLen64)
+	for iter.Next() {
+		for _, b := range [][]byte{iter.Key(), iter.Value()} {
+			n := binary.PutUvarint(buf, uint64(len(b)))
+			bw.Write(buf[:n])
+			bw.Write(b)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	// a failed write is kept by bw and returned here
+	return bw.Flush()
+}
+
+// Restore creates a new datastore at filename from a backup made by Backup.
+func Restore(filename string, r io.Reader) error {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(backupHeader))
+	_, err := io.ReadFull(br, header)
+	if err != nil || string(header) != backupHeader {
+		return fmt.Errorf("not a level backup")
+	}
+
+	db, err := leveldb.OpenFile(filename, &opt.Options{ErrorIfExist: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	batch := new(leveldb.Batch)
+	for {
+		key, err := readEntry(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		val, err := readEntry(br)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+
+		batch.Put(key, val)
+		if batch.Len() == restoreBatch {
+			err = db.Write(batch, nil)
+			if err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	return db.Write(batch, nil)
+}
+
+// readEntry reads a key or a value written by Backup, returning io.EOF only if
+// the backup ended before it.
+func readEntry(br *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(br, b)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return b, err
+}
+
+// PutSchema stores the JSON Schema for keys starting with prefix.
+func (s *levelStore) PutSchema(prefix, schema string) error {
+	return s.db.Put([]byte(schemaPrefix+prefix), []byte(schema), nil)
+}
+
+// DelSchema removes the JSON Schema for prefix.
+func (s *levelStore) DelSchema(prefix string) error {
+	return s.db.Delete([]byte(schemaPrefix+prefix), nil)
+}
+
+func (s *levelStore) IterateSchemas(fn func(prefix, schema string)) error {
+	r := util.Range{
+		Start: []byte(schemaPrefix),
+		Limit: []byte(schemaPrefix + endSeparator),
+	}
+
+	iter := s.db.NewIterator(&r, nil)
+	defer iter.Release()
+	for iter.Next() {
+		k := strings.TrimPrefix(string(iter.Key()), schemaPrefix)
+		v := string(iter.Value())
 		fn(k, v)
 	}
 
-	return nil
+	return iter.Error()
+}
+
+// PutIndex stores the definition of an index.
+func (s *levelStore) PutIndex(name, def string) error {
+	return s.db.Put([]byte(indexPrefix+name), []byte(def), nil)
+}
+
+// DelIndex removes an index's definition and all of its entries.
+func (s *levelStore) DelIndex(name string) error {
+	prefix := entryPrefix + name + separator
+	r := util.Range{
+		Start: []byte(prefix),
+		Limit: []byte(prefix + endSeparator),
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Delete([]byte(indexPrefix + name))
+	iter := s.db.NewIterator(&r, nil)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	err := iter.Error()
+	if err != nil {
+		return err
+	}
+
+	return s.db.Write(batch, nil)
+}
+
+func (s *levelStore) IterateIndexes(fn func(name, def string)) error {
+	r := util.Range{
+		Start: []byte(indexPrefix),
+		Limit: []byte(indexPrefix + endSeparator),
+	}
+
+	iter := s.db.NewIterator(&r, nil)
+	defer iter.Release()
+	for iter.Next() {
+		k := strings.TrimPrefix(string(iter.Key()), indexPrefix)
+		v := string(iter.Value())
+		fn(k, v)
+	}
+
+	return iter.Error()
+}
+
+// SetIndexEntry indexes the key under an (encoded) value, replacing any value
+// it was indexed under before. An empty value removes the key from the index.
+func (s *levelStore) SetIndexEntry(name, key, value string) error {
+	// entries are "entry:<name>:v:<value>\x00<key>" for lookups, and
+	// "entry:<name>:k:<key>" to remember which value the key is indexed under
+	prefix := entryPrefix + name + separator
+	_, err := s.db.Get([]byte(indexPrefix+name), nil)
+	if err == leveldb.ErrNotFound {
+		return fmt.Errorf("unknown index '%s'", name)
+	}
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	old, err := s.db.Get([]byte(prefix+"k:"+key), nil)
+	if err != nil && err != leveldb.ErrNotFound {
+		return err
+	}
+	if err == nil {
+		batch.Delete([]byte(prefix + "v:" + string(old) + "\x00" + key))
+	}
+
+	if value == "" {
+		batch.Delete([]byte(prefix + "k:" + key))
+	} else {
+		batch.Put([]byte(prefix+"v:"+value+"\x00"+key), []byte{})
+		batch.Put([]byte(prefix+"k:"+key), []byte(value))
+	}
+
+	return s.db.Write(batch, nil)
+}
+
+// IterateIndex calls fn with each (encoded) value and key in the index from
+// start (inclusive) to end (exclusive), until fn returns false. An empty end
+// has no upper bound.
+func (s *levelStore) IterateIndex(name, start, end string, fn func(value, key string) bool) error {
+	prefix := entryPrefix + name + separator + "v:"
+	r := util.Range{
+		Start: []byte(prefix + start),
+		Limit: []byte(prefix + end),
+	}
+	if end == "" {
+		r.Limit = []byte(prefix + endSeparator)
+	}
+
+	iter := s.db.NewIterator(&r, nil)
+	defer iter.Release()
+	for iter.Next() {
+		entry := strings.TrimPrefix(string(iter.Key()), prefix)
+		value := strings.SplitN(entry, "\x00", 2)
+		if len(value) == 2 && !fn(value[0], value[1]) {
+			break
+		}
+	}
+
+	return iter.Error()
+}
+
+// PutView stores the definition of a view.
+func (s *levelStore) PutView(name, def string) error {
+	return s.db.Put([]byte(viewPrefix+name), []byte(def), nil)
+}
+
+// DelView removes the definition of a view.
+func (s *levelStore) DelView(name string) error {
+	return s.db.Delete([]byte(viewPrefix+name), nil)
+}
+
+func (s *levelStore) IterateViews(fn func(name, def string)) error {
+	r := util.Range{
+		Start: []byte(viewPrefix),
+		Limit: []byte(viewPrefix + endSeparator),
+	}
+
+	iter := s.db.NewIterator(&r, nil)
+	defer iter.Release()
+	for iter.Next() {
+		k := strings.TrimPrefix(string(iter.Key()), viewPrefix)
+		v := string(iter.Value())
+		fn(k, v)
+	}
+
+	return iter.Error()
 }
 
 // Closes the datastore.
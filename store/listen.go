@@ -0,0 +1,42 @@
+package store
+
+import "sync"
+
+// Listeners is embedded in each datastore to tell anyone listening about every
+// change once it has been written, wherever the change came from.
+type Listeners struct {
+	mu   sync.RWMutex
+	next int
+	fns  map[int]func(change Change)
+}
+
+// Listen calls fn with every change written from now on, until the returned
+// function is called. Since fn is called whilst the write is still returning
+// it must not block.
+func (l *Listeners) Listen(fn func(change Change)) func() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.fns == nil {
+		l.fns = map[int]func(change Change){}
+	}
+	id := l.next
+	l.next++
+	l.fns[id] = fn
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.fns, id)
+	}
+}
+
+// Notify tells every listener about the change.
+func (l *Listeners) Notify(change Change) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for _, fn := range l.fns {
+		fn(change)
+	}
+}
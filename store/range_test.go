@@ -0,0 +1,215 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/modb-dev/modb/store"
+	"github.com/modb-dev/modb/store/badger"
+	"github.com/modb-dev/modb/store/bbolt"
+	"github.com/modb-dev/modb/store/level"
+)
+
+// eachStore runs fn against a fresh datastore of each type.
+func eachStore(t *testing.T, fn func(t *testing.T, db store.Storage)) {
+	opens := []struct {
+		name string
+		open func(string) (store.Storage, error)
+	}{
+		{"bbolt", bbolt.Open},
+		{"level", level.Open},
+		{"badger", badger.Open},
+	}
+	for _, o := range opens {
+		t.Run(o.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "modb-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := o.open(filepath.Join(dir, o.name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			fn(t, db)
+		})
+	}
+}
+
+// rangeKeys are keys which share a prefix, where the log's key:id order differs
+// from key order, spread across more than one batch of 100.
+func rangeKeys() []string {
+	keys := []string{"user", "user:1-x", "user:1:a", "user:10:b", "users"}
+	for i := 0; i < 150; i++ {
+		keys = append(keys, "user:"+strconv.Itoa(i))
+	}
+	return keys
+}
+
+func putKeys(t *testing.T, db store.Storage, keys []string) {
+	for _, key := range keys {
+		// two changes each, so each key has more than one log entry
+		if err := db.Put(key, `{"n":1}`); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Inc(key, `{"n":true}`); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func collectRange(t *testing.T, db store.Storage, start, end string, reverse bool) []string {
+	keys := []string{}
+	err := db.IterateRange(start, end, reverse, func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// expectRange is the keys within [start, end) in key order.
+func expectRange(keys []string, start, end string, reverse bool) []string {
+	var want []string
+	for _, key := range keys {
+		if store.InRange(key, start, end) {
+			want = append(want, key)
+		}
+	}
+	sort.Strings(want)
+	if reverse {
+		for i, j := 0, len(want)-1; i < j; i, j = i+1, j-1 {
+			want[i], want[j] = want[j], want[i]
+		}
+	}
+	if want == nil {
+		want = []string{}
+	}
+	return want
+}
+
+func TestIterateRange(t *testing.T) {
+	keys := rangeKeys()
+	ranges := [][2]string{
+		{"user:", "user:~"},
+		{"user:1", "user:10"},
+		{"user:1", "user:2"},
+		{"user:10", "user:100"},
+		{"user", "user:1"},
+		{"user", "user:"},
+		{"user:", "users"},
+		{"", ""},
+		{"user:5", ""},
+		{"user:1:", "user:1;"},
+	}
+
+	eachStore(t, func(t *testing.T, db store.Storage) {
+		putKeys(t, db, keys)
+		for _, r := range ranges {
+			for _, reverse := range []bool{false, true} {
+				got := collectRange(t, db, r[0], r[1], reverse)
+				want := expectRange(keys, r[0], r[1], reverse)
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("IterateRange(%q, %q, %v) = %v, want %v", r[0], r[1], reverse, got, want)
+				}
+			}
+		}
+	})
+}
+
+func TestIterateRangeStops(t *testing.T) {
+	eachStore(t, func(t *testing.T, db store.Storage) {
+		putKeys(t, db, rangeKeys())
+		var got []string
+		err := db.IterateRange("user:", "user:~", false, func(key string) bool {
+			got = append(got, key)
+			return len(got) < 3
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"user:0", "user:1", "user:1-x"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+}
+
+func TestGetRange(t *testing.T) {
+	keys := rangeKeys()
+	eachStore(t, func(t *testing.T, db store.Storage) {
+		putKeys(t, db, keys)
+		if err := db.Del("user:7", "{}"); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, reverse := range []bool{false, true} {
+			var got []string
+			err := store.GetRange(db, "user:", "user:~", reverse, "", func(key string, doc *store.Doc) bool {
+				got = append(got, key)
+				if !doc.Deleted() && doc.String() != `{"n":2}` {
+					t.Errorf("%s = %s, want {\"n\":2}", key, doc.String())
+				}
+				return true
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := expectRange(keys, "user:", "user:~", reverse)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("GetRange(reverse=%v) gave %d keys %v, want %d keys %v", reverse, len(got), got, len(want), want)
+			}
+		}
+	})
+}
+
+func TestIterateKeys(t *testing.T) {
+	keys := append(rangeKeys(), "user:a", "user:1:b:c")
+	eachStore(t, func(t *testing.T, db store.Storage) {
+		putKeys(t, db, keys)
+		want := expectRange(keys, "", "", false)
+
+		var all []string
+		err := db.IterateKeys("", func(key string) bool {
+			all = append(all, key)
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(all, want) {
+			t.Errorf("IterateKeys(\"\") = %v, want %v", all, want)
+		}
+
+		// one key at a time, carrying on after the last
+		var paged []string
+		after := ""
+		for len(paged) <= len(keys) {
+			next := ""
+			err := db.IterateKeys(after, func(key string) bool {
+				next = key
+				return false
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if next == "" {
+				break
+			}
+			paged = append(paged, next)
+			after = next
+		}
+		if !reflect.DeepEqual(paged, want) {
+			t.Errorf("paging gave %v, want %v", paged, want)
+		}
+	})
+}
@@ -0,0 +1,588 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+// SiblingsField is the field a multi-value register uses to expose its
+// siblings whilst more than one concurrent write is outstanding.
+const SiblingsField = "@siblings"
+
+// TextHead is the position id of the start of a text field, used to insert
+// before any other character.
+const TextHead = "^"
+
+// ops are the names of every op which may appear in the log.
+var ops = map[string]bool{
+	"put": true, "del": true, "inc": true, "incby": true, "max": true, "min": true,
+	"mvset": true, "resolve": true, "textins": true, "textdel": true, "expire": true,
+}
+
+// ValidOp reports whether op is the name of an op Apply knows.
+func ValidOp(op string) bool {
+	return ops[op]
+}
+
+// Doc is a document resolved by replaying a key's changes in order.
+type Doc struct {
+	arena    fastjson.Arena
+	val      *fastjson.Value
+	siblings map[string][]sibling
+	seen     map[string]map[string]bool // ids each register's writers had seen
+	texts    map[string]*text
+	deleted  bool
+	expires  time.Time // zero if the document doesn't expire
+	now      time.Time // when the document is being read, zero for now
+}
+
+// sibling is one concurrent write to a multi-value register.
+type sibling struct {
+	id  string
+	val *fastjson.Value
+}
+
+// text is a replicated sequence of characters, where each character has an id
+// of `<op-id>.<n>` and is inserted after the character (or TextHead) it was
+// typed after. Deleted characters are kept as tombstones so that inserts
+// anchored to them still have a place. Rebuilding the string on every op would
+// make replaying a long text quadratic, so it's only marked dirty, and the
+// field is set once something needs the document's value (see render).
+type text struct {
+	chars    map[string]string
+	children map[string][]string
+	deleted  map[string]bool
+	dirty    bool
+}
+
+// NewDoc returns an empty document, the same as one that has been deleted.
+func NewDoc() *Doc {
+	d := &Doc{}
+	d.reset(d.arena.NewObject())
+	return d
+}
+
+// Get replays all of the key's changes from the datastore. If the key has no
+// changes then a nil Doc is returned.
+func Get(db Storage, key string) (*Doc, error) {
+	return GetAt(db, key, "")
+}
+
+// GetAt replays the key's changes up to and including the op id at, giving the
+// document as it was at that point. An empty at includes every change. If the
+// key had no changes by then a nil Doc is returned.
+func GetAt(db Storage, key, at string) (*Doc, error) {
+	var changes []Change
+	err := db.IterateChanges(key, func(change Change) {
+		if at == "" || change.Id <= at {
+			changes = append(changes, change)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	doc, err := Replay(changes)
+	if err != nil {
+		return nil, err
+	}
+	if at != "" {
+		// so an expiry is judged by the time being read at
+		doc.now, _ = IdTime(at)
+	}
+	return doc, nil
+}
+
+// GetRange resolves each key from start (inclusive) to end (exclusive) in key
+// order, or in reverse, as it was at the op id at (see GetAt), calling fn with
+// each document until fn returns false. Deleted documents are included, so fn
+// should check Doc.Deleted.
+func GetRange(db Storage, start, end string, reverse bool, at string, fn func(key string, doc *Doc) bool) error {
+	var err error
+	rangeErr := db.IterateRange(start, end, reverse, func(key string) bool {
+		var doc *Doc
+		doc, err = GetAt(db, key, at)
+		if err != nil {
+			return false
+		}
+		return doc == nil || fn(key, doc)
+	})
+	if rangeErr != nil {
+		return rangeErr
+	}
+	return err
+}
+
+// Replay resolves the changes, in the order given, into a document.
+func Replay(changes []Change) (*Doc, error) {
+	d := NewDoc()
+	for _, change := range changes {
+		err := d.Apply(change)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// Apply applies one change to the document.
+//
+// Writes are checked with Check before they are accepted, but ops arriving from
+// elsewhere may still conflict with the document's types, so every node
+// resolves them in the same way:
+//
+//   - a `put` of anything other than an object resolves to an empty object
+//   - a counter op (`inc`, `incby`, `max`, `min`) on a field which holds
+//     something other than a number leaves that field as it is
+//   - a counter op on a path running through something other than an object
+//     leaves that path as it is
+//   - an `mvset` or `resolve` which another had seen is superseded by it, even
+//     when a clock running behind gave the other the smaller id
+//
+// A document which has expired is gone by the time of any later op, which then
+// starts again from an empty object just as it would after a `del`.
+func (d *Doc) Apply(change Change) error {
+	// each diff gets its own parser since `put` keeps hold of the parsed value
+	var p fastjson.Parser
+	diff, err := p.Parse(change.Diff)
+	if err != nil {
+		return fmt.Errorf("change %s: %s", change.Id, err)
+	}
+
+	if change.Op != "textins" && change.Op != "textdel" {
+		d.render()
+	}
+
+	if !d.expires.IsZero() {
+		t, err := IdTime(change.Id)
+		if err == nil && !t.Before(d.expires) {
+			d.reset(d.arena.NewObject())
+			d.deleted = true
+		}
+	}
+
+	if change.Op == "expire" {
+		deadline, err := time.Parse(time.RFC3339Nano, string(diff.GetStringBytes("deadline")))
+		if err != nil {
+			return fmt.Errorf("change %s: invalid deadline", change.Id)
+		}
+		d.expires = deadline
+		return nil
+	}
+
+	d.deleted = change.Op == "del"
+
+	switch change.Op {
+	case "put":
+		if diff.Type() != fastjson.TypeObject {
+			diff = d.arena.NewObject()
+		}
+		d.reset(diff)
+	case "del":
+		d.reset(d.arena.NewObject())
+	case "inc":
+		d.merge(d.val, diff, func(curr, val *fastjson.Value) *fastjson.Value {
+			if !isNumber(curr) {
+				return nil
+			}
+			return d.arena.NewNumberFloat64(number(curr) + 1)
+		})
+	case "incby":
+		d.merge(d.val, diff, func(curr, val *fastjson.Value) *fastjson.Value {
+			if !isNumber(curr) {
+				return nil
+			}
+			return d.arena.NewNumberFloat64(number(curr) + number(val))
+		})
+	case "max":
+		d.merge(d.val, diff, func(curr, val *fastjson.Value) *fastjson.Value {
+			if val.Type() != fastjson.TypeNumber || !isNumber(curr) {
+				return nil
+			}
+			if curr != nil && number(curr) >= number(val) {
+				return nil
+			}
+			return val
+		})
+	case "min":
+		d.merge(d.val, diff, func(curr, val *fastjson.Value) *fastjson.Value {
+			if val.Type() != fastjson.TypeNumber || !isNumber(curr) {
+				return nil
+			}
+			if curr != nil && number(curr) <= number(val) {
+				return nil
+			}
+			return val
+		})
+	case "mvset", "resolve":
+		// both ops supersede the siblings the writer had seen, the difference
+		// being only in how the writer decided what it had seen
+		field := string(diff.GetStringBytes("field"))
+		if field == "" {
+			return fmt.Errorf("change %s: missing field", change.Id)
+		}
+		// every id seen is remembered, since a clock running behind can give a
+		// write a smaller id than the one which superseded it, and so have it
+		// replayed afterwards
+		seen := d.seen[field]
+		if seen == nil {
+			seen = map[string]bool{}
+			d.seen[field] = seen
+		}
+		for _, id := range diff.GetArray("seen") {
+			seen[string(id.GetStringBytes())] = true
+		}
+		var siblings []sibling
+		for _, sib := range d.siblings[field] {
+			if !seen[sib.id] {
+				siblings = append(siblings, sib)
+			}
+		}
+		if !seen[change.Id] {
+			siblings = append(siblings, sibling{change.Id, diff.Get("value")})
+		}
+		sort.Slice(siblings, func(i, j int) bool { return siblings[i].id < siblings[j].id })
+		d.siblings[field] = siblings
+		if len(siblings) > 0 {
+			d.set(field, d.register(siblings))
+		}
+	case "textins":
+		field := string(diff.GetStringBytes("field"))
+		if field == "" {
+			return fmt.Errorf("change %s: missing field", change.Id)
+		}
+		t := d.text(field)
+		after := string(diff.GetStringBytes("after"))
+		id := string(diff.GetStringBytes("id"))
+		for i, r := range []rune(string(diff.GetStringBytes("text"))) {
+			charId := fmt.Sprintf("%s.%d", id, i)
+			t.chars[charId] = string(r)
+			t.children[after] = append(t.children[after], charId)
+			after = charId
+		}
+		t.dirty = true
+	case "textdel":
+		field := string(diff.GetStringBytes("field"))
+		if field == "" {
+			return fmt.Errorf("change %s: missing field", change.Id)
+		}
+		t := d.text(field)
+		for _, id := range diff.GetArray("ids") {
+			t.deleted[string(id.GetStringBytes())] = true
+		}
+		t.dirty = true
+	default:
+		return fmt.Errorf("change %s: unknown op '%s'", change.Id, change.Op)
+	}
+
+	return nil
+}
+
+// Deleted reports whether the last op applied to the document was a `del`, or
+// whether the document has expired.
+func (d *Doc) Deleted() bool {
+	return d.deleted || d.Expired()
+}
+
+// DeletedAt is Deleted as it was at t, judging any expiry by t rather than by
+// now.
+func (d *Doc) DeletedAt(t time.Time) bool {
+	return d.deleted || (!d.expires.IsZero() && !t.Before(d.expires))
+}
+
+// Expired reports whether the document's deadline has passed.
+func (d *Doc) Expired() bool {
+	if d.expires.IsZero() {
+		return false
+	}
+	now := d.now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	return !now.Before(d.expires)
+}
+
+// Expires returns when the document expires, or zero if it doesn't.
+func (d *Doc) Expires() time.Time {
+	return d.expires
+}
+
+// Value returns the document's JSON value.
+func (d *Doc) Value() *fastjson.Value {
+	d.render()
+	return d.val
+}
+
+// Check returns an error if the change breaks the type rules for ops when
+// applied to this document: `put` and `del` bodies must be objects, counter ops
+// may only touch fields which are numbers or do not yet exist, and `expire`
+// needs a deadline.
+func (d *Doc) Check(change Change) error {
+	var p fastjson.Parser
+	diff, err := p.Parse(change.Diff)
+	if err != nil {
+		return err
+	}
+
+	switch change.Op {
+	case "put", "del":
+		if diff.Type() != fastjson.TypeObject {
+			return fmt.Errorf("%s body must be an object", change.Op)
+		}
+	case "inc", "incby", "max", "min":
+		if diff.Type() != fastjson.TypeObject {
+			return fmt.Errorf("%s body must be an object", change.Op)
+		}
+		return checkCounters(change.Op, d.Value(), diff, "")
+	case "expire":
+		_, err := time.Parse(time.RFC3339Nano, string(diff.GetStringBytes("deadline")))
+		if err != nil {
+			return fmt.Errorf("expire needs an RFC3339 deadline")
+		}
+	}
+
+	return nil
+}
+
+// checkCounters makes sure each leaf in diff lands on a number (or nothing) in
+// curr, with only objects (or nothing) along the way.
+func checkCounters(op string, curr, diff *fastjson.Value, path string) error {
+	var err error
+	diff.GetObject().Visit(func(k []byte, val *fastjson.Value) {
+		if err != nil {
+			return
+		}
+		field := path + string(k)
+		var existing *fastjson.Value
+		if curr != nil {
+			existing = curr.Get(string(k))
+		}
+
+		if val.Type() == fastjson.TypeObject {
+			if existing != nil && existing.Type() != fastjson.TypeObject {
+				err = fmt.Errorf("%s field '%s' is a %s, not an object", op, field, existing.Type())
+				return
+			}
+			err = checkCounters(op, existing, val, field+".")
+			return
+		}
+
+		if op == "inc" && val.Type() != fastjson.TypeTrue {
+			err = fmt.Errorf("%s field '%s' must be true", op, field)
+			return
+		}
+		if op != "inc" && val.Type() != fastjson.TypeNumber {
+			err = fmt.Errorf("%s field '%s' must be a number", op, field)
+			return
+		}
+		if !isNumber(existing) {
+			err = fmt.Errorf("%s field '%s' is a %s, not a number", op, field, existing.Type())
+		}
+	})
+	return err
+}
+
+// Siblings returns the ids of the concurrent writes currently held in the
+// multi-value register at field.
+func (d *Doc) Siblings(field string) []string {
+	var ids []string
+	for _, sib := range d.siblings[field] {
+		ids = append(ids, sib.id)
+	}
+	return ids
+}
+
+// TextIds returns the ids of the visible characters in the text field, in
+// order, so that clients can address positions for `textins` and `textdel`.
+func (d *Doc) TextIds(field string) []string {
+	t, ok := d.texts[field]
+	if !ok {
+		return nil
+	}
+	var ids []string
+	t.walk(func(id string) {
+		ids = append(ids, id)
+	})
+	return ids
+}
+
+// HasTextId reports whether id is a character in the text field, or TextHead,
+// so that an insert can be anchored to it. Deleted characters still count.
+func (d *Doc) HasTextId(field, id string) bool {
+	if id == TextHead {
+		return true
+	}
+	t, ok := d.texts[field]
+	if !ok {
+		return false
+	}
+	_, ok = t.chars[id]
+	return ok
+}
+
+// String returns the document as JSON.
+func (d *Doc) String() string {
+	d.render()
+	return d.val.String()
+}
+
+// reset replaces the whole document, forgetting any registers and expiry.
+func (d *Doc) reset(val *fastjson.Value) {
+	d.val = val
+	d.siblings = map[string][]sibling{}
+	d.seen = map[string]map[string]bool{}
+	d.texts = map[string]*text{}
+	d.expires = time.Time{}
+}
+
+// text returns the text sequence at field, creating it if required.
+func (d *Doc) text(field string) *text {
+	t, ok := d.texts[field]
+	if !ok {
+		t = &text{
+			chars:    map[string]string{},
+			children: map[string][]string{},
+			deleted:  map[string]bool{},
+		}
+		d.texts[field] = t
+	}
+	return t
+}
+
+// render sets each text field changed since the last render to its string, in
+// field order.
+func (d *Doc) render() {
+	var fields []string
+	for field, t := range d.texts {
+		if t.dirty {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		d.set(field, d.arena.NewString(d.texts[field].String()))
+		d.texts[field].dirty = false
+	}
+}
+
+// walk visits each visible character id in order. Concurrent inserts after
+// the same character are ordered newest first, which keeps every node in
+// agreement regardless of the order the ops arrived in. Each character is
+// usually inserted after the one before it, so the walk keeps its own stack
+// rather than recursing once per character.
+func (t *text) walk(fn func(id string)) {
+	// children are pushed oldest first so that the newest is visited first
+	var stack []string
+	push := func(after string) {
+		ids := append([]string{}, t.children[after]...)
+		sort.Strings(ids)
+		stack = append(stack, ids...)
+	}
+
+	push(TextHead)
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !t.deleted[id] {
+			fn(id)
+		}
+		push(id)
+	}
+}
+
+// String returns the visible characters.
+func (t *text) String() string {
+	var b strings.Builder
+	t.walk(func(id string) {
+		b.WriteString(t.chars[id])
+	})
+	return b.String()
+}
+
+// register returns the value of a multi-value register. A single sibling is
+// just its value, otherwise all siblings are listed under SiblingsField.
+func (d *Doc) register(siblings []sibling) *fastjson.Value {
+	if len(siblings) == 1 {
+		return siblings[0].val
+	}
+
+	list := d.arena.NewArray()
+	for i, sib := range siblings {
+		item := d.arena.NewObject()
+		item.Set("id", d.arena.NewString(sib.id))
+		item.Set("value", sib.val)
+		list.SetArrayItem(i, item)
+	}
+	obj := d.arena.NewObject()
+	obj.Set(SiblingsField, list)
+	return obj
+}
+
+// set sets the value at the dotted path in the document, creating any
+// intermediate objects required.
+func (d *Doc) set(path string, val *fastjson.Value) {
+	keys := strings.Split(path, ".")
+	dst := d.val
+	for _, key := range keys[:len(keys)-1] {
+		child := dst.Get(key)
+		if child == nil || child.Type() != fastjson.TypeObject {
+			child = d.arena.NewObject()
+			dst.Set(key, child)
+		}
+		dst = child
+	}
+	dst.Set(keys[len(keys)-1], val)
+}
+
+// merge walks the (nested) fields in diff and sets each leaf in dst to the
+// result of fn, creating any intermediate objects required. If fn returns nil
+// the leaf is left as it is.
+func (d *Doc) merge(dst, diff *fastjson.Value, fn func(curr, val *fastjson.Value) *fastjson.Value) {
+	obj, err := diff.Object()
+	if err != nil {
+		return
+	}
+
+	obj.Visit(func(k []byte, val *fastjson.Value) {
+		key := string(k)
+		if val.Type() == fastjson.TypeObject {
+			child := dst.Get(key)
+			if child == nil {
+				child = d.arena.NewObject()
+				dst.Set(key, child)
+			}
+			if child.Type() == fastjson.TypeObject {
+				d.merge(child, val, fn)
+			}
+			return
+		}
+		if v := fn(dst.Get(key), val); v != nil {
+			dst.Set(key, v)
+		}
+	})
+}
+
+// isNumber reports whether a field can be counted, i.e. it is a number or
+// doesn't exist yet.
+func isNumber(val *fastjson.Value) bool {
+	return val == nil || val.Type() == fastjson.TypeNumber
+}
+
+// number returns the value as a float, or zero if it is missing or not a number.
+func number(val *fastjson.Value) float64 {
+	if val == nil {
+		return 0
+	}
+	f, err := val.Float64()
+	if err != nil {
+		return 0
+	}
+	return f
+}
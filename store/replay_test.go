@@ -0,0 +1,254 @@
+package store_test
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/modb-dev/modb/store"
+)
+
+var base = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// id returns an op id n seconds after base, so ids sort in the order of n.
+func id(n int) string {
+	return store.IdAt(base.Add(time.Duration(n) * time.Second))
+}
+
+// changes gives the ops, each as op and diff, ids in the order given.
+func changes(key string, ops ...[2]string) []store.Change {
+	var list []store.Change
+	for i, op := range ops {
+		list = append(list, store.Change{Key: key, Id: id(i + 1), Op: op[0], Diff: op[1]})
+	}
+	return list
+}
+
+func TestApply(t *testing.T) {
+	deadline := base.Add(2500 * time.Millisecond).Format(time.RFC3339Nano)
+	tests := []struct {
+		name string
+		ops  [][2]string
+		want string
+	}{
+		{"put of an array", [][2]string{{"put", `{"a":1}`}, {"put", `[1,2]`}}, `{}`},
+		{"put of a string", [][2]string{{"put", `"str"`}}, `{}`},
+		{"put of a number", [][2]string{{"put", `{"a":1}`}, {"put", `7`}}, `{}`},
+		{"inc on a string", [][2]string{{"put", `{"n":"x"}`}, {"inc", `{"n":true}`}}, `{"n":"x"}`},
+		{"incby on an object", [][2]string{{"put", `{"n":{"m":1}}`}, {"incby", `{"n":5}`}}, `{"n":{"m":1}}`},
+		{"max on an array", [][2]string{{"put", `{"n":[1]}`}, {"max", `{"n":5}`}}, `{"n":[1]}`},
+		{"min on a bool", [][2]string{{"put", `{"n":true}`}, {"min", `{"n":5}`}}, `{"n":true}`},
+		{"counter on a missing field", [][2]string{{"put", `{}`}, {"incby", `{"n":5}`}, {"max", `{"m":3}`}}, `{"n":5,"m":3}`},
+		{"inc through a string", [][2]string{{"put", `{"a":"x"}`}, {"inc", `{"a":{"b":true}}`}}, `{"a":"x"}`},
+		{"incby through a number", [][2]string{{"put", `{"a":1}`}, {"incby", `{"a":{"b":{"c":2}}}`}}, `{"a":1}`},
+		{"inc through a missing object", [][2]string{{"put", `{}`}, {"inc", `{"a":{"b":true}}`}}, `{"a":{"b":1}}`},
+		{"op after expiry", [][2]string{{"put", `{"a":1}`}, {"expire", `{"deadline":"` + deadline + `"}`}, {"inc", `{"n":true}`}}, `{"n":1}`},
+		{"op before expiry", [][2]string{{"put", `{"a":1}`}, {"inc", `{"n":true}`}, {"expire", `{"deadline":"` + deadline + `"}`}}, `{"a":1,"n":1}`},
+		{"op after del", [][2]string{{"put", `{"a":1}`}, {"del", `{}`}, {"inc", `{"n":true}`}}, `{"n":1}`},
+	}
+
+	for _, test := range tests {
+		doc, err := store.Replay(changes("k", test.ops...))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if doc.String() != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, doc.String(), test.want)
+		}
+	}
+}
+
+func TestMaxMin(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  [][2]string
+		want string
+	}{
+		{"max first write", [][2]string{{"max", `{"n":5}`}}, `{"n":5}`},
+		{"min first write", [][2]string{{"min", `{"n":5}`}}, `{"n":5}`},
+		{"max equal", [][2]string{{"max", `{"n":5}`}, {"max", `{"n":5}`}}, `{"n":5}`},
+		{"min equal", [][2]string{{"min", `{"n":5}`}, {"min", `{"n":5}`}}, `{"n":5}`},
+		{"max higher", [][2]string{{"max", `{"n":5}`}, {"max", `{"n":7.5}`}}, `{"n":7.5}`},
+		{"max lower", [][2]string{{"max", `{"n":5}`}, {"max", `{"n":-2}`}}, `{"n":5}`},
+		{"min higher", [][2]string{{"min", `{"n":5}`}, {"min", `{"n":7.5}`}}, `{"n":5}`},
+		{"min lower", [][2]string{{"min", `{"n":5}`}, {"min", `{"n":-2}`}}, `{"n":-2}`},
+		{"max over a put", [][2]string{{"put", `{"n":10}`}, {"max", `{"n":3}`}, {"max", `{"n":11}`}}, `{"n":11}`},
+		{"min over a put", [][2]string{{"put", `{"n":10}`}, {"min", `{"n":11}`}, {"min", `{"n":3}`}}, `{"n":3}`},
+		{"max on a string", [][2]string{{"put", `{"n":"x"}`}, {"max", `{"n":5}`}}, `{"n":"x"}`},
+		{"min on a null", [][2]string{{"put", `{"n":null}`}, {"min", `{"n":5}`}}, `{"n":null}`},
+		{"max of a string", [][2]string{{"put", `{"n":1}`}, {"max", `{"n":"9"}`}}, `{"n":1}`},
+		{"nested max", [][2]string{{"max", `{"a":{"b":2}}`}, {"max", `{"a":{"b":1,"c":3}}`}}, `{"a":{"b":2,"c":3}}`},
+	}
+
+	for _, test := range tests {
+		doc, err := store.Replay(changes("k", test.ops...))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if doc.String() != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, doc.String(), test.want)
+		}
+	}
+}
+
+func TestMvSet(t *testing.T) {
+	// changes gives the ops ids id(1), id(2), ... in order
+	write := func(op string, value int, seen ...int) [2]string {
+		ids := []string{}
+		for _, n := range seen {
+			ids = append(ids, `"`+id(n)+`"`)
+		}
+		return [2]string{op, `{"field":"r","value":` + strconv.Itoa(value) + `,"seen":[` + strings.Join(ids, ",") + `]}`}
+	}
+	mv := func(value int, seen ...int) [2]string {
+		return write("mvset", value, seen...)
+	}
+	siblings := func(ns ...int) string {
+		var list []string
+		for _, n := range ns {
+			list = append(list, `{"id":"`+id(n)+`","value":`+strconv.Itoa(n)+`}`)
+		}
+		return `{"r":{"@siblings":[` + strings.Join(list, ",") + `]}}`
+	}
+
+	tests := []struct {
+		name string
+		ops  [][2]string
+		want string
+	}{
+		{"one write", [][2]string{mv(1)}, `{"r":1}`},
+		{"concurrent writes", [][2]string{mv(1), mv(2)}, siblings(1, 2)},
+		{"three concurrent writes", [][2]string{mv(1), mv(2), mv(3)}, siblings(1, 2, 3)},
+		{"write having seen the other", [][2]string{mv(1), mv(2, 1)}, `{"r":2}`},
+		{"write having seen one of two", [][2]string{mv(1), mv(2), mv(3, 1)}, siblings(2, 3)},
+		{"resolve of both", [][2]string{mv(1), mv(2), write("resolve", 3, 1, 2)}, `{"r":3}`},
+		{"seen id which doesn't exist", [][2]string{mv(1), mv(2, 7)}, siblings(1, 2)},
+		{"superseded write with a later id", [][2]string{mv(1, 2), mv(2)}, `{"r":1}`},
+		{"superseded write after a concurrent one", [][2]string{mv(1), mv(2, 3), mv(3)}, siblings(1, 2)},
+		{"put forgets the register", [][2]string{mv(1), mv(2), {"put", `{"a":1}`}, mv(4)}, `{"a":1,"r":4}`},
+		{"other fields kept", [][2]string{{"put", `{"a":1}`}, mv(2)}, `{"a":1,"r":2}`},
+	}
+
+	for _, test := range tests {
+		doc, err := store.Replay(changes("k", test.ops...))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if doc.String() != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, doc.String(), test.want)
+		}
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		op   [2]string
+	}{
+		{"unparseable diff", [2]string{"put", `{bad`}},
+		{"unknown op", [2]string{"frob", `{}`}},
+		{"invalid deadline", [2]string{"expire", `{"deadline":"never"}`}},
+		{"mvset without a field", [2]string{"mvset", `{"value":1}`}},
+	}
+	for _, test := range tests {
+		_, err := store.Replay(changes("k", test.op))
+		if err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
+
+// TestArrivalOrder writes the same ops into a datastore in the order they were
+// made and in reverse, as they might arrive from elsewhere, and expects the
+// same document either way.
+func TestArrivalOrder(t *testing.T) {
+	ops := changes("k",
+		[2]string{"put", `{"a":1,"s":"x","n":{"m":1}}`},
+		[2]string{"inc", `{"a":true,"s":true}`},
+		[2]string{"incby", `{"n":{"m":2},"s":{"t":3}}`},
+		[2]string{"max", `{"a":10}`},
+		[2]string{"min", `{"b":-1}`},
+		[2]string{"put", `[1]`},
+		[2]string{"inc", `{"a":true}`},
+		[2]string{"mvset", `{"field":"r","value":1,"seen":[]}`},
+		[2]string{"mvset", `{"field":"r","value":2,"seen":[]}`},
+		[2]string{"mvset", `{"field":"q","value":1,"seen":["` + id(11) + `"]}`},
+		[2]string{"mvset", `{"field":"q","value":2,"seen":[]}`},
+		[2]string{"resolve", `{"field":"r","value":3,"seen":["` + id(8) + `","` + id(9) + `"]}`},
+	)
+	reversed := make([]store.Change, len(ops))
+	for i, change := range ops {
+		reversed[len(ops)-1-i] = change
+	}
+
+	eachStore(t, func(t *testing.T, db store.Storage) {
+		var docs []string
+		for i, list := range [][]store.Change{ops, reversed} {
+			// one change at a time, as each would arrive
+			key := []string{"forward", "reverse"}[i]
+			for _, change := range list {
+				change.Key = key
+				if _, err := db.Append([]store.Change{change}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			doc, err := store.Get(db, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			docs = append(docs, doc.String())
+		}
+		if docs[0] != docs[1] {
+			t.Errorf("in order gave %s, reversed gave %s", docs[0], docs[1])
+		}
+	})
+}
+
+func TestText(t *testing.T) {
+	long := strings.Repeat("abcdefghij", 10000)
+	tests := []struct {
+		name string
+		ops  [][2]string
+		want string
+	}{
+		{"insert at the start", [][2]string{
+			{"textins", `{"field":"t","after":"^","id":"a","text":"world"}`},
+			{"textins", `{"field":"t","after":"^","id":"b","text":"hello "}`},
+		}, `{"t":"hello world"}`},
+		{"insert after a deleted character", [][2]string{
+			{"textins", `{"field":"t","after":"^","id":"a","text":"abc"}`},
+			{"textdel", `{"field":"t","ids":["a.1"]}`},
+			{"textins", `{"field":"t","after":"a.1","id":"b","text":"X"}`},
+		}, `{"t":"aXc"}`},
+		{"concurrent inserts, newest first", [][2]string{
+			{"textins", `{"field":"t","after":"^","id":"a","text":"-"}`},
+			{"textins", `{"field":"t","after":"a.0","id":"c","text":"2"}`},
+			{"textins", `{"field":"t","after":"a.0","id":"b","text":"1"}`},
+		}, `{"t":"-21"}`},
+		{"long text", [][2]string{
+			{"textins", `{"field":"t","after":"^","id":"a","text":"` + long + `"}`},
+		}, `{"t":"` + long + `"}`},
+		{"other ops between", [][2]string{
+			{"textins", `{"field":"t","after":"^","id":"a","text":"ab"}`},
+			{"incby", `{"n":2}`},
+			{"textins", `{"field":"t","after":"a.1","id":"b","text":"c"}`},
+			{"put", `{"x":1}`},
+			{"textins", `{"field":"t","after":"^","id":"c","text":"z"}`},
+		}, `{"x":1,"t":"z"}`},
+	}
+
+	for _, test := range tests {
+		doc, err := store.Replay(changes("k", test.ops...))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if doc.String() != test.want {
+			t.Errorf("%s: got %.100s, want %.100s", test.name, doc.String(), test.want)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package store
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// Signature returns how many changes the key has and a SHA-256 over all of
+// them, so two nodes can tell cheaply whether they hold the same ledger.
+func Signature(db Storage, key string) (int, string, error) {
+	count := 0
+	h := sha256.New()
+	err := db.IterateChanges(key, func(change Change) {
+		count++
+		line := change.Id + ":" + change.Key + ":" + change.Op + ":" + change.Diff + "\n"
+		h.Write([]byte(line))
+	})
+	if err != nil {
+		return 0, "", err
+	}
+
+	return count, fmt.Sprintf("%x", h.Sum(nil)), nil
+}
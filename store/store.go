@@ -1,5 +1,18 @@
 package store
 
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+// Separator joins a key and an op id in the log, and an op and its diff.
+const Separator = ":"
+
 // Change is a tuple of key, id, op, and diff.
 type Change struct {
 	Key  string
@@ -8,14 +21,170 @@ type Change struct {
 	Diff string
 }
 
+// Data is a raw data entry, being a key and its value.
+type Data struct {
+	Key string
+	Val string
+}
+
+// JSON returns the change as {"key", "id", "op", "diff"}, with the diff left as
+// the raw JSON it already is, or made into a string if it isn't valid JSON so
+// that the whole is.
+func (c Change) JSON() string {
+	key, _ := json.Marshal(c.Key)
+	id, _ := json.Marshal(c.Id)
+	op, _ := json.Marshal(c.Op)
+	diff := c.Diff
+	if fastjson.Validate(diff) != nil {
+		b, _ := json.Marshal(diff)
+		diff = string(b)
+	}
+	return `{"key":` + string(key) + `,"id":` + string(id) + `,"op":` + string(op) + `,"diff":` + diff + `}`
+}
+
 type Storage interface {
 	Put(key, json string) error
 	Inc(key, json string) error
 	IncBy(key, json string) error
 	Del(key, json string) error
+	Max(key, json string) error
+	Min(key, json string) error
+	MvSet(key, json string) error
+	Resolve(key, json string) error
+	TextIns(key, json string) error
+	TextDel(key, json string) error
+	Expire(key, json string) error
 	// Get(key string) error
+	Append(changes []Change) (int, error)
+	PutData(key, val string) error
+	PutDataBatch(entries []Data) error
 	IterateChanges(key string, fn func(change Change)) error
-	IterateLog(fn func(key, val string)) error
-	IterateData(fn func(key, val string)) error
+	Purge(key, upto string) error
+	Quarantine(log bool, key string) error
+	IterateKeys(after string, fn func(key string) bool) error
+	IterateRange(start, end string, reverse bool, fn func(key string) bool) error
+	IterateLog(start string, fn func(key, val string) bool) error
+	IterateData(start string, fn func(key, val string) bool) error
+	Backup(w io.Writer) error
+	PutSchema(prefix, schema string) error
+	DelSchema(prefix string) error
+	IterateSchemas(fn func(prefix, schema string)) error
+	PutIndex(name, def string) error
+	DelIndex(name string) error
+	IterateIndexes(fn func(name, def string)) error
+	SetIndexEntry(name, key, value string) error
+	IterateIndex(name, start, end string, fn func(value, key string) bool) error
+	PutView(name, def string) error
+	DelView(name string) error
+	IterateViews(fn func(name, def string)) error
+	Listen(fn func(change Change)) func()
 	Close() error
 }
+
+// InRange reports whether key is within [start, end), where an empty end has no
+// upper bound.
+func InRange(key, start, end string) bool {
+	return key >= start && (end == "" || key < end)
+}
+
+// IterateKeyRange implements IterateRange on top of a datastore's IterateLog,
+// calling fn for each distinct key from start (inclusive) to end (exclusive) in
+// key order, or in reverse, until fn returns false. The log is ordered by
+// key:id rather than by key, so "user:10:id" comes before "user:1:id", and a
+// key's entries can sort after end when the key is a prefix of it. The keys are
+// collected and sorted first, and fn is only called once iterating is done, so
+// it's free to read the datastore.
+func IterateKeyRange(iterateLog func(start string, fn func(key, val string) bool) error, start, end string, reverse bool, fn func(key string) bool) error {
+	seen := make(map[string]bool)
+	var keys []string
+	err := iterateLog(start, func(k, v string) bool {
+		if end != "" && k >= end {
+			return false
+		}
+		key, id := SplitLogKey(k)
+		if id != "" && !seen[key] && InRange(key, start, end) {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	// a key which is a prefix of end, followed by anything up to the separator,
+	// has its entries at or after end
+	for i := 1; i < len(end); i++ {
+		key := end[:i]
+		if end[i] > Separator[0] || seen[key] || !InRange(key, start, end) {
+			continue
+		}
+		from := key + Separator
+		if end > from {
+			from = end
+		}
+		found := false
+		err := iterateLog(from, func(k, v string) bool {
+			if !strings.HasPrefix(k, key+Separator) {
+				return false
+			}
+			found = !strings.Contains(k[len(key)+1:], Separator)
+			return !found
+		})
+		if err != nil {
+			return err
+		}
+		if found {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	for i := range keys {
+		key := keys[i]
+		if reverse {
+			key = keys[len(keys)-1-i]
+		}
+		if !fn(key) {
+			break
+		}
+	}
+	return nil
+}
+
+// IterateKeysAfter implements IterateKeys on top of IterateKeyRange, calling fn
+// for each distinct key after the one given (or from the start if it is empty)
+// in key order, until fn returns false. Being in key order, the last key fn was
+// given can be used as after to carry on from where it left off.
+func IterateKeysAfter(iterateLog func(start string, fn func(key, val string) bool) error, after string, fn func(key string) bool) error {
+	start := ""
+	if after != "" {
+		// the first string which sorts after the key
+		start = after + "\x00"
+	}
+	return IterateKeyRange(iterateLog, start, "", false, fn)
+}
+
+// SplitLogKey splits a log entry's key into the document key and the op id.
+// Ids never contain the separator, though keys may.
+func SplitLogKey(k string) (key, id string) {
+	i := strings.LastIndex(k, Separator)
+	if i < 0 {
+		return k, ""
+	}
+	return k[:i], k[i+1:]
+}
+
+// ParseLogEntry turns a raw log entry, as given by IterateLog, into a Change.
+func ParseLogEntry(k, v string) (Change, error) {
+	key, id := SplitLogKey(k)
+	if id == "" {
+		return Change{}, fmt.Errorf("log entry '%s' has no op id", k)
+	}
+	opDiff := strings.SplitN(v, Separator, 2)
+	if len(opDiff) != 2 {
+		return Change{}, fmt.Errorf("log entry '%s' has no op", k)
+	}
+	return Change{Key: key, Id: id, Op: opDiff[0], Diff: opDiff[1]}, nil
+}